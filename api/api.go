@@ -7,27 +7,72 @@ const (
 	MoveDown
 )
 
+// Values of board cells other than snakes.
+// A snake cell has the positive remaining lifetime.
+const (
+	CellEmpty = 0
+	CellApple = -1
+	CellWall  = -2
+
+	CellItemGrow       = -3
+	CellItemShrink     = -4
+	CellItemSpeed      = -5
+	CellItemGhost      = -6
+	CellItemMultiplier = -7
+)
+
 type Message struct {
 	UUID string `json:"uuid"`
 	Path string `json:"path"`
 	Body []byte `json:"body"`
 }
 
+// Types of EventRequest.
+const (
+	// EventTypeMove changes the direction to Key
+	EventTypeMove = iota
+	// EventTypeRestart asks for a rematch after the match finished
+	EventTypeRestart
+)
+
 type EventRequest struct {
 	UUID      string `json:"uuid"`
 	Eventtype int    `json:"eventtype"`
 	Key       int    `json:"key"`
 }
 
+type Point struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type EffectResponse struct {
+	Kind string `json:"kind"`
+	// Remaining is the ticks until the effect ends
+	Remaining int `json:"remaining"`
+}
+
 type PlayerResponse struct {
 	ID        string `json:"id"`
 	X         int    `json:"x"`
 	Y         int    `json:"y"`
 	Size      int    `json:"size"`
 	Direction int    `json:"direction"`
+	// Body is the cells of the snake ordered from head to tail
+	Body     []Point          `json:"body"`
+	KilledBy string           `json:"killed_by,omitempty"`
+	Score    int              `json:"score"`
+	Effects  []EffectResponse `json:"effects"`
+	// Dead is true after the snake died. A dead player watches the rest of the match.
+	Dead bool `json:"dead,omitempty"`
+	// Latency is the round-trip time to the client of the player in milliseconds, 0 until it is measured
+	Latency int `json:"latency"`
+	// Team is the ID of the team of the player, or 0 if the match has no teams
+	Team int `json:"team,omitempty"`
 }
 
 type ResponseBody struct {
+	Tick    int              `json:"tick"`
 	Board   []int            `json:"board"`
 	Width   int              `json:"width"`
 	Height  int              `json:"height"`
@@ -35,13 +80,89 @@ type ResponseBody struct {
 }
 
 type EventResponse struct {
-	Status int          `json:"status"`
-	Body   ResponseBody `json:"body"`
+	Status int `json:"status"`
+	// You is the ID of the recipient, which is added by Codec.Envelope to the frame shared by every recipient.
+	// It is empty for spectators.
+	You  string       `json:"you,omitempty"`
+	Body ResponseBody `json:"body"`
+	// Error is the reason of GameStatusError
+	Error string `json:"error,omitempty"`
+}
+
+type GameConfig struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// PlayerNum is the maximum players of a match
+	PlayerNum int `json:"player_num"`
+	// MinPlayers is the players needed to start the countdown to the match
+	MinPlayers int `json:"min_players"`
+	// Countdown is the seconds more players can join after MinPlayers have joined
+	Countdown      int          `json:"countdown"`
+	InitSize       int          `json:"init_size"`
+	TickInterval   int          `json:"tick_interval"`
+	AppleNum       int          `json:"apple_num"`
+	GrowthPerApple int          `json:"growth_per_apple"`
+	Topology       string       `json:"topology"`
+	Items          []ItemConfig `json:"items"`
+	WinCondition   string       `json:"win_condition"`
+	TargetLength   int          `json:"target_length,omitempty"`
+	TimeLimit      int          `json:"time_limit,omitempty"`
+	RematchTimeout int          `json:"rematch_timeout"`
+	ResumeGrace    int          `json:"resume_grace"`
+	// KeyframeInterval is the ticks between full frames for clients which receive delta frames
+	KeyframeInterval int `json:"keyframe_interval"`
+	// Teams are the teams players are assigned to at the start of a match. It is empty if the match has no teams.
+	Teams []TeamConfig `json:"teams,omitempty"`
+	// TeamBodies is whether the bodies of teammates are lethal or passable
+	TeamBodies string `json:"team_bodies,omitempty"`
+}
+
+type TeamConfig struct {
+	// ID starts from 1
+	ID int `json:"id"`
+	// Color is the color of the snakes of the team in "#rrggbb"
+	Color string `json:"color"`
 }
 
+type ItemConfig struct {
+	Kind     string  `json:"kind"`
+	Rate     float64 `json:"rate"`
+	Lifetime int     `json:"lifetime"`
+	Duration int     `json:"duration"`
+	Amount   int     `json:"amount"`
+}
+
+// Topology is how the edges of the board behave.
+const (
+	// TopologyWall kills snakes which go out of the board
+	TopologyWall = "wall"
+	// TopologyTorus wraps edges to the opposite side
+	TopologyTorus = "torus"
+)
+
+// Win conditions. In a team match, teams are ranked instead of players:
+// the last team standing wins with WinLastAlive, and the highest combined length of the team wins otherwise.
+const (
+	WinLastAlive = "last_alive"
+	WinLength    = "length"
+	WinTimeLimit = "time_limit"
+)
+
+// How the bodies of teammates behave in a team match.
+const (
+	// TeamBodyLethal kills a snake which runs into a teammate like any other snake
+	TeamBodyLethal = "lethal"
+	// TeamBodyPassable lets a snake pass through the bodies of its teammates
+	TeamBodyPassable = "passable"
+)
+
 type InitResponse struct {
-	Status int    `json:"status"`
-	ID     string `json:"id"`
+	Status    int        `json:"status"`
+	ID        string     `json:"id"`
+	Config    GameConfig `json:"config"`
+	Spectator bool       `json:"spectator,omitempty"`
+	// Token resumes the session by Hello.Resume after the connection dropped
+	Token string `json:"token,omitempty"`
 }
 
 const (
@@ -49,4 +170,103 @@ const (
 	GameStatusOK
 	GameStatusError
 	GameStatusWaiting
+	GameStatusFinished
+	// GameStatusDelta is a frame with changes from the last frame, sent to clients which asked for delta frames
+	GameStatusDelta
+	// GameStatusWelcome answers the hello of the client
+	GameStatusWelcome
 )
+
+// CellChange is a cell whose value changed from the last frame.
+type CellChange struct {
+	X     int `json:"x"`
+	Y     int `json:"y"`
+	Value int `json:"value"`
+}
+
+type DeltaBody struct {
+	Tick  int          `json:"tick"`
+	Cells []CellChange `json:"cells"`
+	// Players are the players whose state changed from the last frame
+	Players []PlayerResponse `json:"players"`
+}
+
+// ApplyDelta updates the frame with the changes of the next tick.
+func (b *ResponseBody) ApplyDelta(d DeltaBody) {
+	b.Tick = d.Tick
+	for _, c := range d.Cells {
+		b.Board[c.Y*b.Width+c.X] = c.Value
+	}
+	for _, p := range d.Players {
+		for i := range b.Players {
+			if b.Players[i].ID == p.ID {
+				b.Players[i] = p
+				break
+			}
+		}
+	}
+}
+
+// DeltaResponse is applied to the board and players of the last frame.
+// Clients receive a full frame of GameStatusOK as a keyframe at first and every keyframe interval.
+type DeltaResponse struct {
+	Status int `json:"status"`
+	// You is the same as EventResponse.You
+	You  string    `json:"you,omitempty"`
+	Body DeltaBody `json:"body"`
+}
+
+// Standing is the result of a player in a finished match.
+type Standing struct {
+	ID string `json:"id"`
+	// Rank starts from 1. Players in a tie share the rank.
+	Rank   int `json:"rank"`
+	Length int `json:"length"`
+	Score  int `json:"score"`
+	Kills  int `json:"kills"`
+	// SurvivalTicks is the ticks the snake was alive
+	SurvivalTicks int  `json:"survival_ticks"`
+	Alive         bool `json:"alive"`
+	// Team is the ID of the team of the player. Players share the rank of their team in a team match.
+	Team int `json:"team,omitempty"`
+}
+
+// TeamStanding is the result of a team in a finished team match.
+type TeamStanding struct {
+	Team int `json:"team"`
+	Rank int `json:"rank"`
+	// Length is the combined length of the snakes of the team
+	Length int `json:"length"`
+	// Alive is true if any snake of the team is alive
+	Alive bool `json:"alive"`
+}
+
+type ResultBody struct {
+	Tick      int        `json:"tick"`
+	Standings []Standing `json:"standings"`
+	// Teams are the standings of teams ordered by rank, which is empty if the match has no teams
+	Teams []TeamStanding `json:"teams,omitempty"`
+}
+
+type WaitingBody struct {
+	// Players is the number of players in the room
+	Players int `json:"players"`
+	// Needed is the number of players still needed to start the countdown
+	Needed     int `json:"needed"`
+	MaxPlayers int `json:"max_players"`
+	// SecondsLeft is the seconds until the match starts, or 0 if the countdown has not started
+	SecondsLeft int `json:"seconds_left"`
+}
+
+// WaitingResponse is sent to everyone in the room whenever the matchmaking state changes,
+// and every second of the countdown.
+type WaitingResponse struct {
+	Status int         `json:"status"`
+	Body   WaitingBody `json:"body"`
+}
+
+// ResultResponse is sent to every participant when the match finishes.
+type ResultResponse struct {
+	Status int        `json:"status"`
+	Body   ResultBody `json:"body"`
+}
@@ -0,0 +1,484 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// BinaryCodec packs frames much smaller than JSON, which matters for the board sent every tick.
+//
+// Every frame starts with the status in one byte, followed by the body of the frame.
+// Integers are varints (zigzag-encoded if they can be negative), strings and lists are
+// prefixed by their length, and a player record starts with a fixed layout:
+//
+//	id string | x, y, size, score, latency int32 | direction byte | flags byte | team byte | killed_by string | body | effects
+//
+// A board is the list of cells in row-major order, and each cell is one byte in most cases.
+// EventResponse and DeltaResponse have the recipient right after the status, which is
+// replaced by Envelope. Requests have no status, and are encoded as eventtype, key and uuid.
+type BinaryCodec struct{}
+
+var (
+	errShortFrame = errors.New("binary frame is too short")
+	errOutOfRange = errors.New("binary value is out of range")
+)
+
+const flagDead = 1
+
+func (BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	var e encoder
+	switch v := v.(type) {
+	case *EventRequest:
+		e.uint(v.Eventtype)
+		e.int(v.Key)
+		e.string(v.UUID)
+	case *EventResponse:
+		e.byte(byte(v.Status))
+		e.string(v.You)
+		e.uint(v.Body.Tick)
+		e.uint(v.Body.Width)
+		e.uint(v.Body.Height)
+		e.uint(len(v.Body.Board))
+		for _, c := range v.Body.Board {
+			e.int(c)
+		}
+		e.players(v.Body.Players)
+		e.string(v.Error)
+	case *InitResponse:
+		e.byte(byte(v.Status))
+		e.string(v.ID)
+		e.bool(v.Spectator)
+		e.string(v.Token)
+		e.config(&v.Config)
+	case *DeltaResponse:
+		e.byte(byte(v.Status))
+		e.string(v.You)
+		e.uint(v.Body.Tick)
+		e.uint(len(v.Body.Cells))
+		for _, c := range v.Body.Cells {
+			e.uint(c.X)
+			e.uint(c.Y)
+			e.int(c.Value)
+		}
+		e.players(v.Body.Players)
+	case *WaitingResponse:
+		e.byte(byte(v.Status))
+		e.uint(v.Body.Players)
+		e.uint(v.Body.Needed)
+		e.uint(v.Body.MaxPlayers)
+		e.uint(v.Body.SecondsLeft)
+	case *ResultResponse:
+		e.byte(byte(v.Status))
+		e.uint(v.Body.Tick)
+		e.uint(len(v.Body.Standings))
+		for _, s := range v.Body.Standings {
+			e.string(s.ID)
+			e.uint(s.Rank)
+			e.uint(s.Length)
+			e.int(s.Score)
+			e.uint(s.Kills)
+			e.uint(s.SurvivalTicks)
+			e.bool(s.Alive)
+			e.uint(s.Team)
+		}
+		e.uint(len(v.Body.Teams))
+		for _, s := range v.Body.Teams {
+			e.uint(s.Team)
+			e.uint(s.Rank)
+			e.uint(s.Length)
+			e.bool(s.Alive)
+		}
+	default:
+		return nil, fmt.Errorf("binary codec does not support %T", v)
+	}
+	return e.buf, nil
+}
+
+func (BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	d := decoder{data: data}
+	switch v := v.(type) {
+	case *EventRequest:
+		v.Eventtype = d.uint()
+		v.Key = d.int()
+		v.UUID = d.string()
+	case *EventResponse:
+		v.Status = int(d.byte())
+		v.You = d.string()
+		v.Body.Tick = d.uint()
+		v.Body.Width = d.uint()
+		v.Body.Height = d.uint()
+		v.Body.Board = nil
+		if n := d.count(); n > 0 {
+			v.Body.Board = make([]int, n)
+			for i := range v.Body.Board {
+				v.Body.Board[i] = d.int()
+			}
+		}
+		v.Body.Players = d.players()
+		v.Error = d.string()
+	case *InitResponse:
+		v.Status = int(d.byte())
+		v.ID = d.string()
+		v.Spectator = d.bool()
+		v.Token = d.string()
+		d.config(&v.Config)
+	case *DeltaResponse:
+		v.Status = int(d.byte())
+		v.You = d.string()
+		v.Body.Tick = d.uint()
+		v.Body.Cells = nil
+		if n := d.count(); n > 0 {
+			v.Body.Cells = make([]CellChange, n)
+			for i := range v.Body.Cells {
+				v.Body.Cells[i] = CellChange{X: d.uint(), Y: d.uint(), Value: d.int()}
+			}
+		}
+		v.Body.Players = d.players()
+	case *WaitingResponse:
+		v.Status = int(d.byte())
+		v.Body.Players = d.uint()
+		v.Body.Needed = d.uint()
+		v.Body.MaxPlayers = d.uint()
+		v.Body.SecondsLeft = d.uint()
+	case *ResultResponse:
+		v.Status = int(d.byte())
+		v.Body.Tick = d.uint()
+		v.Body.Standings = nil
+		if n := d.count(); n > 0 {
+			v.Body.Standings = make([]Standing, n)
+			for i := range v.Body.Standings {
+				v.Body.Standings[i] = Standing{
+					ID:            d.string(),
+					Rank:          d.uint(),
+					Length:        d.uint(),
+					Score:         d.int(),
+					Kills:         d.uint(),
+					SurvivalTicks: d.uint(),
+					Alive:         d.bool(),
+					Team:          d.uint(),
+				}
+			}
+		}
+		v.Body.Teams = nil
+		if n := d.count(); n > 0 {
+			v.Body.Teams = make([]TeamStanding, n)
+			for i := range v.Body.Teams {
+				v.Body.Teams[i] = TeamStanding{
+					Team:   d.uint(),
+					Rank:   d.uint(),
+					Length: d.uint(),
+					Alive:  d.bool(),
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("binary codec does not support %T", v)
+	}
+	if d.err == nil && len(d.data) > 0 {
+		return fmt.Errorf("binary frame has %d extra bytes", len(d.data))
+	}
+	return d.err
+}
+
+func (BinaryCodec) Status(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, errShortFrame
+	}
+	return int(data[0]), nil
+}
+
+func (BinaryCodec) Binary() bool {
+	return true
+}
+
+// Envelope replaces the empty recipient, which is the byte after the status.
+func (BinaryCodec) Envelope(frame []byte, you string) []byte {
+	if you == "" || len(frame) < 2 {
+		return frame
+	}
+	var e encoder
+	e.buf = make([]byte, 0, len(frame)+len(you)+1)
+	e.byte(frame[0])
+	e.string(you)
+	e.buf = append(e.buf, frame[2:]...)
+	return e.buf
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) byte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+// uint writes a non-negative integer.
+func (e *encoder) uint(v int) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(v))
+	e.buf = append(e.buf, b[:n]...)
+}
+
+func (e *encoder) int(v int) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], int64(v))
+	e.buf = append(e.buf, b[:n]...)
+}
+
+func (e *encoder) int32(v int) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(int32(v)))
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.byte(1)
+	} else {
+		e.byte(0)
+	}
+}
+
+func (e *encoder) string(s string) {
+	e.uint(len(s))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) float(f float64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) players(players []PlayerResponse) {
+	e.uint(len(players))
+	for _, p := range players {
+		e.string(p.ID)
+		e.int32(p.X)
+		e.int32(p.Y)
+		e.int32(p.Size)
+		e.int32(p.Score)
+		e.int32(p.Latency)
+		e.byte(byte(p.Direction))
+		var flags byte
+		if p.Dead {
+			flags |= flagDead
+		}
+		e.byte(flags)
+		e.byte(byte(p.Team))
+		e.string(p.KilledBy)
+		e.uint(len(p.Body))
+		for _, b := range p.Body {
+			e.int(b.X)
+			e.int(b.Y)
+		}
+		e.uint(len(p.Effects))
+		for _, ef := range p.Effects {
+			e.string(ef.Kind)
+			e.uint(ef.Remaining)
+		}
+	}
+}
+
+func (e *encoder) config(c *GameConfig) {
+	e.uint(c.Width)
+	e.uint(c.Height)
+	e.uint(c.PlayerNum)
+	e.uint(c.MinPlayers)
+	e.uint(c.Countdown)
+	e.uint(c.InitSize)
+	e.uint(c.TickInterval)
+	e.uint(c.AppleNum)
+	e.uint(c.GrowthPerApple)
+	e.string(c.Topology)
+	e.string(c.WinCondition)
+	e.uint(c.TargetLength)
+	e.uint(c.TimeLimit)
+	e.uint(c.RematchTimeout)
+	e.uint(c.ResumeGrace)
+	e.uint(c.KeyframeInterval)
+	e.uint(len(c.Items))
+	for _, it := range c.Items {
+		e.string(it.Kind)
+		e.float(it.Rate)
+		e.uint(it.Lifetime)
+		e.uint(it.Duration)
+		e.int(it.Amount)
+	}
+	e.uint(len(c.Teams))
+	for _, t := range c.Teams {
+		e.uint(t.ID)
+		e.string(t.Color)
+	}
+	e.string(c.TeamBodies)
+}
+
+// decoder reads values in the order of encoder.
+// The first error is kept in err, and every read after it returns zero values.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.data) < n {
+		d.err = errShortFrame
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errShortFrame
+		return 0
+	}
+	// a larger value would be a negative int, which breaks lengths of lists and strings
+	if v > math.MaxInt32 {
+		d.err = errOutOfRange
+		return 0
+	}
+	d.data = d.data[n:]
+	return int(v)
+}
+
+func (d *decoder) int() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errShortFrame
+		return 0
+	}
+	d.data = d.data[n:]
+	return int(v)
+}
+
+func (d *decoder) int32() int {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return int(int32(binary.LittleEndian.Uint32(b)))
+}
+
+func (d *decoder) bool() bool {
+	return d.byte() != 0
+}
+
+func (d *decoder) string() string {
+	return string(d.next(d.count()))
+}
+
+func (d *decoder) float() float64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b))
+}
+
+// count reads the length of a list.
+// Every element takes at least one byte, so a longer length than the rest of the frame is broken.
+func (d *decoder) count() int {
+	n := d.uint()
+	if n < 0 || n > len(d.data) {
+		d.err = errShortFrame
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) players() []PlayerResponse {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	players := make([]PlayerResponse, n)
+	for i := range players {
+		p := &players[i]
+		p.ID = d.string()
+		p.X = d.int32()
+		p.Y = d.int32()
+		p.Size = d.int32()
+		p.Score = d.int32()
+		p.Latency = d.int32()
+		p.Direction = int(d.byte())
+		p.Dead = d.byte()&flagDead != 0
+		p.Team = int(d.byte())
+		p.KilledBy = d.string()
+		if m := d.count(); m > 0 {
+			p.Body = make([]Point, m)
+			for j := range p.Body {
+				p.Body[j] = Point{X: d.int(), Y: d.int()}
+			}
+		}
+		if m := d.count(); m > 0 {
+			p.Effects = make([]EffectResponse, m)
+			for j := range p.Effects {
+				p.Effects[j] = EffectResponse{Kind: d.string(), Remaining: d.uint()}
+			}
+		}
+	}
+	return players
+}
+
+func (d *decoder) config(c *GameConfig) {
+	c.Width = d.uint()
+	c.Height = d.uint()
+	c.PlayerNum = d.uint()
+	c.MinPlayers = d.uint()
+	c.Countdown = d.uint()
+	c.InitSize = d.uint()
+	c.TickInterval = d.uint()
+	c.AppleNum = d.uint()
+	c.GrowthPerApple = d.uint()
+	c.Topology = d.string()
+	c.WinCondition = d.string()
+	c.TargetLength = d.uint()
+	c.TimeLimit = d.uint()
+	c.RematchTimeout = d.uint()
+	c.ResumeGrace = d.uint()
+	c.KeyframeInterval = d.uint()
+	c.Items = nil
+	if n := d.count(); n > 0 {
+		c.Items = make([]ItemConfig, n)
+		for i := range c.Items {
+			c.Items[i] = ItemConfig{
+				Kind:     d.string(),
+				Rate:     d.float(),
+				Lifetime: d.uint(),
+				Duration: d.uint(),
+				Amount:   d.int(),
+			}
+		}
+	}
+	c.Teams = nil
+	if n := d.count(); n > 0 {
+		c.Teams = make([]TeamConfig, n)
+		for i := range c.Teams {
+			c.Teams[i] = TeamConfig{ID: d.uint(), Color: d.string()}
+		}
+	}
+	c.TeamBodies = d.string()
+}
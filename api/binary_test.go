@@ -0,0 +1,145 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBinaryCodec_RoundTrip(t *testing.T) {
+	player := PlayerResponse{
+		ID:        "a",
+		X:         3,
+		Y:         -1,
+		Size:      4,
+		Direction: MoveDown,
+		Body:      []Point{{3, -1}, {3, 0}},
+		KilledBy:  "b",
+		Score:     12,
+		Latency:   48,
+		Effects:   []EffectResponse{{Kind: "speed", Remaining: 5}},
+		Dead:      true,
+		Team:      2,
+	}
+	frames := []struct {
+		in  interface{}
+		out interface{}
+	}{
+		{&EventRequest{UUID: "a", Eventtype: EventTypeMove, Key: MoveUp}, &EventRequest{}},
+		{&EventResponse{Status: GameStatusWaiting}, &EventResponse{}},
+		{&WaitingResponse{
+			Status: GameStatusWaiting,
+			Body:   WaitingBody{Players: 3, Needed: 0, MaxPlayers: 4, SecondsLeft: 7},
+		}, &WaitingResponse{}},
+		{&EventResponse{Status: GameStatusError, Error: "room is full"}, &EventResponse{}},
+		{&EventResponse{
+			Status: GameStatusOK,
+			Body: ResponseBody{
+				Tick:    300,
+				Board:   []int{0, CellApple, CellWall, 2, 1, CellItemMultiplier},
+				Width:   3,
+				Height:  2,
+				Players: []PlayerResponse{player, {ID: "b"}},
+			},
+		}, &EventResponse{}},
+		{&InitResponse{
+			Status: GameStatusInit,
+			ID:     "a",
+			Config: GameConfig{
+				Width:        40,
+				Height:       40,
+				PlayerNum:    4,
+				MinPlayers:   2,
+				Countdown:    10,
+				Topology:     TopologyTorus,
+				WinCondition: WinLength,
+				TargetLength: 10,
+				Items:        []ItemConfig{{Kind: "shrink", Rate: 0.25, Lifetime: 30, Amount: -2}},
+				Teams:        []TeamConfig{{ID: 1, Color: "#e74c3c"}, {ID: 2, Color: "#3498db"}},
+				TeamBodies:   TeamBodyPassable,
+			},
+			Spectator: true,
+			Token:     "token",
+		}, &InitResponse{}},
+		{&DeltaResponse{
+			Status: GameStatusDelta,
+			Body: DeltaBody{
+				Tick:    301,
+				Cells:   []CellChange{{X: 1, Y: 0, Value: 3}, {X: 2, Y: 1, Value: CellEmpty}},
+				Players: []PlayerResponse{player},
+			},
+		}, &DeltaResponse{}},
+		{&ResultResponse{
+			Status: GameStatusFinished,
+			Body: ResultBody{
+				Tick:      400,
+				Standings: []Standing{{ID: "a", Rank: 1, Length: 8, Score: -3, Kills: 2, SurvivalTicks: 400, Alive: true, Team: 2}},
+				Teams:     []TeamStanding{{Team: 2, Rank: 1, Length: 8, Alive: true}, {Team: 1, Rank: 2, Length: 5}},
+			},
+		}, &ResultResponse{}},
+	}
+
+	var codec BinaryCodec
+	for _, f := range frames {
+		data, err := codec.Marshal(f.in)
+		if err != nil {
+			t.Fatalf("%T: %v", f.in, err)
+		}
+		err = codec.Unmarshal(data, f.out)
+		if err != nil {
+			t.Fatalf("%T: %v", f.in, err)
+		}
+		if !reflect.DeepEqual(f.in, f.out) {
+			t.Errorf("%T: expected %+v, but got %+v", f.in, f.in, f.out)
+		}
+	}
+}
+
+func TestBinaryCodec_Broken(t *testing.T) {
+	var codec BinaryCodec
+	data, _ := codec.Marshal(&EventResponse{
+		Status: GameStatusOK,
+		Body:   ResponseBody{Board: []int{1, 2, 3}, Width: 3, Height: 1},
+	})
+
+	var resp EventResponse
+	err := codec.Unmarshal(data[:len(data)-2], &resp)
+	if err == nil {
+		t.Errorf("expected error for a short frame")
+	}
+	err = codec.Unmarshal(append(data, 0), &resp)
+	if err == nil {
+		t.Errorf("expected error for extra bytes")
+	}
+	// a length above MaxInt64 must not wrap around to a negative length
+	err = codec.Unmarshal([]byte{0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, &EventRequest{})
+	if err == nil {
+		t.Errorf("expected error for a huge length")
+	}
+	_, err = codec.Status(nil)
+	if err == nil {
+		t.Errorf("expected error for an empty frame")
+	}
+}
+
+func TestCodec_Envelope(t *testing.T) {
+	frame := &EventResponse{
+		Status: GameStatusOK,
+		Body:   ResponseBody{Tick: 1, Board: []int{0, 1}, Width: 2, Height: 1, Players: []PlayerResponse{{ID: "a"}}},
+	}
+	for _, codec := range []Codec{JSONCodec{}, BinaryCodec{}} {
+		data, _ := codec.Marshal(frame)
+
+		var resp EventResponse
+		err := codec.Unmarshal(codec.Envelope(data, `a"b`), &resp)
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		if resp.You != `a"b` {
+			t.Errorf("%T: expected you 'a\"b', but got '%s'", codec, resp.You)
+		}
+		resp.You = ""
+		if resp.Body.Tick != frame.Body.Tick || !reflect.DeepEqual(resp.Body.Board, frame.Body.Board) {
+			t.Errorf("%T: expected %+v, but got %+v", codec, frame, resp)
+		}
+	}
+}
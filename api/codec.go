@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Encodings of frames on the wire.
+const (
+	// EncodingJSON sends frames as websocket text messages. It is the default.
+	EncodingJSON = "json"
+	// EncodingBinary sends frames as websocket binary messages in the compact layout of BinaryCodec
+	EncodingBinary = "binary"
+)
+
+// Codec encodes requests and frames in an encoding.
+// Marshal and Unmarshal accept pointers to EventRequest, EventResponse, InitResponse,
+// DeltaResponse, WaitingResponse and ResultResponse.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	// Status returns the status of the frame, which decides the type to unmarshal it to
+	Status(data []byte) (int, error)
+	// Binary is true if the encoded data is sent as websocket binary messages
+	Binary() bool
+	// Envelope sets You of the encoded EventResponse or DeltaResponse without encoding it again,
+	// so that a frame is encoded once and shared by every recipient. The frame must have empty You.
+	Envelope(frame []byte, you string) []byte
+}
+
+// NewCodec returns the codec of the encoding. An empty encoding means EncodingJSON.
+func NewCodec(encoding string) (Codec, error) {
+	switch encoding {
+	case "", EncodingJSON:
+		return JSONCodec{}, nil
+	case EncodingBinary:
+		return BinaryCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown encoding '%s'", encoding)
+}
+
+// JSONCodec is readable for debugging and the browser frontend.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (JSONCodec) Status(data []byte) (int, error) {
+	var resp struct {
+		Status int `json:"status"`
+	}
+	err := json.Unmarshal(data, &resp)
+	return resp.Status, err
+}
+
+func (JSONCodec) Binary() bool {
+	return false
+}
+
+// Envelope adds the field "you" at the head of the object.
+func (JSONCodec) Envelope(frame []byte, you string) []byte {
+	if you == "" || len(frame) < 2 {
+		return frame
+	}
+	id, _ := json.Marshal(you)
+	ret := make([]byte, 0, len(frame)+len(id)+7)
+	ret = append(ret, `{"you":`...)
+	ret = append(ret, id...)
+	ret = append(ret, ',')
+	return append(ret, frame[1:]...)
+}
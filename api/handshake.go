@@ -0,0 +1,62 @@
+package api
+
+// ProtocolVersion is the version of the protocol in this package.
+// It changes when frames or requests change incompatibly.
+const ProtocolVersion = 4
+
+// Encodings are the encodings the server supports.
+var Encodings = []string{EncodingJSON, EncodingBinary}
+
+// Hello is the first message from the client, which is always JSON.
+// The server answers with Welcome, or with an error frame if the client is incompatible.
+type Hello struct {
+	Version int `json:"version"`
+	// Encodings are the encodings the client can read in order of preference. Empty means EncodingJSON.
+	Encodings []string `json:"encodings"`
+	// Delta asks for delta frames between keyframes
+	Delta bool `json:"delta,omitempty"`
+	// Spectate joins a match as a read-only observer
+	Spectate bool `json:"spectate,omitempty"`
+	// Resume is the token of the session to resume after the connection dropped
+	Resume string `json:"resume,omitempty"`
+	// Client is the name and version of the client, used in logs of the server
+	Client string `json:"client,omitempty"`
+}
+
+// BuildInfo tells which build of the server the client talks to.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+}
+
+// Welcome is always JSON. Frames after it are in Encoding.
+type Welcome struct {
+	Status  int `json:"status"`
+	Version int `json:"version"`
+	// Encoding is the encoding chosen from the hello
+	Encoding string `json:"encoding"`
+	// Encodings are every encoding the server supports
+	Encodings []string   `json:"encodings"`
+	Server    BuildInfo  `json:"server"`
+	Config    GameConfig `json:"config"`
+	// PingInterval is how often the server pings in milliseconds.
+	// A client can regard the server as dead if nothing arrives for a few intervals.
+	PingInterval int `json:"ping_interval"`
+}
+
+// ChooseEncoding returns the first encoding of preferred which the server supports,
+// or empty if there is none.
+func ChooseEncoding(preferred []string) string {
+	if len(preferred) == 0 {
+		return EncodingJSON
+	}
+	for _, p := range preferred {
+		for _, e := range Encodings {
+			if p == e {
+				return e
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Query parameters of the gameserver websocket to join a named room.
+// A room is created by the first client which asks for its name, and a code given
+// by that client makes the room private: later clients must give the same code.
+const (
+	QueryRoom = "room"
+	QueryCode = "code"
+)
+
+// RoomsAnnotation is the annotation of the game server which lists the names of its rooms separated by commas.
+// Agones prefixes annotations set by the SDK with "agones.dev/sdk-".
+const RoomsAnnotation = "rooms"
+
+var roomName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ValidateRoomName returns error if the name can not be a room name.
+// Names are short and safe to put in URLs and annotations.
+func ValidateRoomName(name string) error {
+	if !roomName.MatchString(name) {
+		return fmt.Errorf("room name must be 1 to 32 letters, digits, '-' or '_' (%q)", name)
+	}
+	return nil
+}
@@ -3,26 +3,38 @@ package main
 import (
 	"context"
 	"net/http"
+	"strings"
 
 	v1 "agones.dev/agones/pkg/apis/agones/v1"
 	"agones.dev/agones/pkg/client/clientset/versioned"
 	"agones.dev/agones/pkg/util/runtime"
 	"github.com/gin-gonic/gin"
+	"github.com/myoan/snake/api"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/rest"
 )
 
+// roomsAnnotation lists the names of the rooms on a game server separated by commas.
+// It is set by the gameserver through the Agones SDK, which prefixes the key.
+const roomsAnnotation = "agones.dev/sdk-" + api.RoomsAnnotation
+
 type GameServerSchema struct {
 	IP    string `json:"ip"`
 	State string `json:"state"`
 	Port  int    `json:"port"`
+	// Room is the name of the room to join on the server, which is given to the gameserver by the query parameter
+	Room string `json:"room,omitempty"`
+}
+
+type CreateRoomRequest struct {
+	Name string `json:"name"`
 }
 
 func HealthHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, "hoge")
 }
 
-func RoomHandler(c *gin.Context) {
+func listGameServers() []v1.GameServer {
 	config, err := rest.InClusterConfig()
 	logger := runtime.NewLoggerWithSource("main")
 	if err != nil {
@@ -38,11 +50,25 @@ func RoomHandler(c *gin.Context) {
 	if err != nil {
 		panic(err)
 	}
+	return result.Items
+}
+
+func newSchema(item *v1.GameServer) GameServerSchema {
+	return GameServerSchema{
+		// TODO: change to IP-port.domain.com
+		// IP:    item.Status.Address,
+		IP:    "hoge.in.game.myoan.dev",
+		State: string(item.Status.State),
+		Port:  int(item.Status.Ports[0].Port),
+	}
+}
 
+// findReadyServer returns the Ready server which has the lowest port.
+func findReadyServer(items []v1.GameServer) (GameServerSchema, bool) {
 	var schema GameServerSchema
 	minport := 100000
-	c.Writer.Header().Set("Access-Control-Allow-Origin", "https://snake.game.myoan.dev")
-	for _, item := range result.Items {
+	for i := range items {
+		item := &items[i]
 		if item.Status.State != v1.GameServerStateReady {
 			continue
 		}
@@ -54,27 +80,97 @@ func RoomHandler(c *gin.Context) {
 
 		port := int(item.Status.Ports[0].Port)
 		if minport > port {
-			schema = GameServerSchema{
-				// TODO: change to IP-port.domain.com
-				// IP:    item.Status.Address,
-				IP:    "hoge.in.game.myoan.dev",
-				State: string(item.Status.State),
-				Port:  port,
-			}
+			schema = newSchema(item)
 			minport = port
 		}
 	}
+	return schema, minport != 100000
+}
 
-	if minport == 100000 {
+// findRoomServer returns the server which hosts the room of the name.
+func findRoomServer(items []v1.GameServer, name string) (GameServerSchema, bool) {
+	for i := range items {
+		item := &items[i]
+		if item.Status.State != v1.GameServerStateReady && item.Status.State != v1.GameServerStateAllocated {
+			continue
+		}
+		if len(item.Status.Ports) < 1 {
+			continue
+		}
+		for _, room := range strings.Split(item.ObjectMeta.Annotations[roomsAnnotation], ",") {
+			if room == name {
+				schema := newSchema(item)
+				schema.Room = name
+				return schema, true
+			}
+		}
+	}
+	return GameServerSchema{}, false
+}
+
+// RoomHandler returns the server to join.
+// With the name query parameter, it returns the server which hosts the room,
+// or a Ready server where the room is created by the first client.
+func RoomHandler(c *gin.Context) {
+	c.Writer.Header().Set("Access-Control-Allow-Origin", "https://snake.game.myoan.dev")
+	name := c.Query("name")
+	if name != "" {
+		if err := api.ValidateRoomName(name); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"msg": err.Error()})
+			return
+		}
+	}
+	items := listGameServers()
+
+	if name != "" {
+		if schema, ok := findRoomServer(items, name); ok {
+			c.JSON(http.StatusOK, schema)
+			return
+		}
+	}
+
+	schema, ok := findReadyServer(items)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"msg": "Ready state server not found."})
+		return
+	}
+	schema.Room = name
+	c.JSON(http.StatusOK, schema)
+}
+
+// CreateRoomHandler returns a Ready server for a new room of the name.
+// The room is created when the first client connects with the name, and the join code if it is private.
+func CreateRoomHandler(c *gin.Context) {
+	c.Writer.Header().Set("Access-Control-Allow-Origin", "https://snake.game.myoan.dev")
+	var req CreateRoomRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "Room name is required."})
+		return
+	}
+	// the gameserver rejects the same names when the first client connects
+	if err := api.ValidateRoomName(req.Name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": err.Error()})
+		return
+	}
+	items := listGameServers()
+
+	if _, ok := findRoomServer(items, req.Name); ok {
+		c.JSON(http.StatusConflict, gin.H{"msg": "Room already exists."})
+		return
+	}
+	schema, ok := findReadyServer(items)
+	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{"msg": "Ready state server not found."})
-	} else {
-		c.JSON(http.StatusOK, schema)
+		return
 	}
+	schema.Room = req.Name
+	c.JSON(http.StatusOK, schema)
 }
 
 func main() {
 	r := gin.Default()
 	r.GET("/", HealthHandler)
 	r.GET("/room", RoomHandler)
+	r.POST("/room", CreateRoomHandler)
 	r.Run()
 }
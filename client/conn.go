@@ -1,8 +1,11 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
+	"log"
+	"net"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -23,55 +26,135 @@ const (
 	StatusWait
 	StatusStart
 	StatusDrop
+	// StatusResult shows the result of the match, and the player can ask for a rematch
+	StatusResult
 )
 
 type Conn struct {
 	conn    *websocket.Conn
 	event   chan int
+	restart chan struct{}
 	webDone chan struct{}
 	funcMap map[int]func([]byte) error
 	UUID    string
+	// Token resumes the session within Grace after the connection dropped
+	Token   string
+	Grace   time.Duration
+	closing bool
+	// encoding is the encoding the client prefers
+	encoding string
+	// codec encodes requests and decodes frames in the encoding the server chose
+	codec api.Codec
+	// Server is the build of the server, which is told in the welcome
+	Server api.BuildInfo
+	// room and code ask the server for a named room, which is private if the code is given
+	room string
+	code string
+	// pongWait is how long the client waits for anything from the server before it regards the server as dead
+	pongWait time.Duration
+	// lost is closed when the connection is gone for good, which ends Connect
+	lost   chan struct{}
+	onLost func(error)
+	mu     sync.Mutex
 }
 
-func NewConn() *Conn {
+func NewConn(encoding string) *Conn {
 	event := make(chan int)
 	done := make(chan struct{})
 	fm := make(map[int]func([]byte) error)
 	return &Conn{
-		webDone: done,
-		event:   event,
-		funcMap: fm,
+		webDone:  done,
+		event:    event,
+		restart:  make(chan struct{}),
+		funcMap:  fm,
+		encoding: encoding,
+		codec:    api.JSONCodec{},
 	}
 }
 
+// SendDirection sends the turn to the server. It is dropped if the connection is lost.
 func (conn *Conn) SendDirection(d Direction) {
-	conn.event <- int(d)
+	select {
+	case conn.event <- int(d):
+	case <-conn.lostCh():
+	}
 }
 
-func (conn *Conn) Connect(addr string) {
-	u := url.URL{Scheme: "ws", Host: addr, Path: "/"}
+// SendRestart asks for a rematch after the match finished.
+func (conn *Conn) SendRestart() {
+	select {
+	case conn.restart <- struct{}{}:
+	case <-conn.lostCh():
+	}
+}
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+// SetRoom makes Connect join the named room with the join code instead of any public room.
+func (conn *Conn) SetRoom(name, code string) {
+	conn.room = name
+	conn.code = code
+}
+
+func (conn *Conn) lostCh() chan struct{} {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.lost
+}
+
+// Connect connects to the gameserver.
+// If spectate is true, it joins a match as a read-only observer.
+// The lost handler is called if the connection fails, or drops and can not be resumed.
+func (conn *Conn) Connect(addr string, spectate bool) {
+	lost := make(chan struct{})
+	conn.mu.Lock()
+	conn.lost = lost
+	conn.closing = false
+	conn.mu.Unlock()
+
+	c, err := conn.dial(addr, &api.Hello{
+		// the client applies delta frames between keyframes
+		Delta:    true,
+		Spectate: spectate,
+	})
 	if err != nil {
+		log.Printf("connect: %v", err)
+		close(lost)
+		conn.lose(err)
 		return
 	}
+	conn.mu.Lock()
 	conn.conn = c
+	conn.mu.Unlock()
 
 	go func() {
+		defer close(lost)
 		for {
 			_, message, err := c.ReadMessage()
 			if err != nil {
-				return
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					err = fmt.Errorf("server is not responding for %v", conn.pongWait)
+				}
+				log.Printf("read: %v", err)
+				c = conn.resume(addr)
+				if c == nil {
+					conn.lose(err)
+					return
+				}
+				continue
 			}
-			var resp map[string]interface{}
-			err = json.Unmarshal(message, &resp)
+			if conn.pongWait > 0 {
+				c.SetReadDeadline(time.Now().Add(conn.pongWait))
+			}
+			status, err := conn.codec.Status(message)
 			if err != nil {
 				return
 			}
-			fstatus := resp["status"].(float64)
-			istatus := int(fstatus)
 
-			err = conn.funcMap[istatus](message)
+			fn, ok := conn.funcMap[status]
+			if !ok {
+				log.Printf("unknown status %d", status)
+				continue
+			}
+			err = fn(message)
 			if err != nil {
 				return
 			}
@@ -83,24 +166,23 @@ func (conn *Conn) Connect(addr string) {
 		case ctrl := <-conn.event:
 			event := &api.EventRequest{
 				UUID:      conn.UUID,
-				Eventtype: 0,
+				Eventtype: api.EventTypeMove,
 				Key:       ctrl,
 			}
-			bytes, _ := json.Marshal(&event)
-
-			msg := &api.Message{
-				UUID: conn.UUID,
-				Path: "move",
-				Body: bytes,
-			}
-			msgbytes, _ := json.Marshal(&msg)
-			err := c.WriteMessage(websocket.TextMessage, msgbytes)
-			if err != nil {
-				return
+			// inputs are dropped while the connection is resuming
+			conn.write(event)
+		case <-conn.restart:
+			event := &api.EventRequest{
+				UUID:      conn.UUID,
+				Eventtype: api.EventTypeRestart,
 			}
+			conn.write(event)
 		case <-conn.webDone:
 			// Cleanly close the connection by sending a close message and then
 			// waiting (with timeout) for the server to close the connection.
+			conn.mu.Lock()
+			c := conn.conn
+			conn.mu.Unlock()
 			err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 			if err != nil {
 				return
@@ -110,10 +192,143 @@ func (conn *Conn) Connect(addr string) {
 			case <-time.After(time.Second):
 			}
 			return
+		case <-lost:
+			conn.mu.Lock()
+			conn.conn.Close()
+			conn.mu.Unlock()
+			return
 		}
 	}
 }
 
+// SetLostHandler sets the function called when the connection to the server is lost.
+func (conn *Conn) SetLostHandler(fn func(error)) {
+	conn.onLost = fn
+}
+
+// lose tells the lost handler, unless the connection is closed on purpose.
+func (conn *Conn) lose(err error) {
+	conn.mu.Lock()
+	closing := conn.closing
+	conn.mu.Unlock()
+	if closing || conn.onLost == nil {
+		return
+	}
+	conn.onLost(err)
+}
+
+// keepalive answers pings of the server, and makes reads fail if the server sends nothing for a few ping intervals.
+func (conn *Conn) keepalive(c *websocket.Conn, interval time.Duration) {
+	conn.pongWait = 3 * interval
+	if conn.pongWait <= 0 {
+		return
+	}
+	c.SetReadDeadline(time.Now().Add(conn.pongWait))
+	c.SetPingHandler(func(data string) error {
+		c.SetReadDeadline(time.Now().Add(conn.pongWait))
+		return c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+}
+
+func (conn *Conn) write(req *api.EventRequest) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	data, err := conn.codec.Marshal(req)
+	if err != nil {
+		return err
+	}
+	mt := websocket.TextMessage
+	if conn.codec.Binary() {
+		mt = websocket.BinaryMessage
+	}
+	return conn.conn.WriteMessage(mt, data)
+}
+
+// Unmarshal decodes the frame given to handlers.
+func (conn *Conn) Unmarshal(data []byte, v interface{}) error {
+	return conn.codec.Unmarshal(data, v)
+}
+
+// dial connects to the server and exchanges the hello and the welcome.
+// The server rejects an incompatible client with the reason.
+func (conn *Conn) dial(addr string, hello *api.Hello) (*websocket.Conn, error) {
+	u := url.URL{Scheme: "ws", Host: addr, Path: "/"}
+	if conn.room != "" {
+		q := url.Values{}
+		q.Set(api.QueryRoom, conn.room)
+		if conn.code != "" {
+			q.Set(api.QueryCode, conn.code)
+		}
+		u.RawQuery = q.Encode()
+	}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hello.Version = api.ProtocolVersion
+	hello.Encodings = []string{conn.encoding, api.EncodingJSON}
+	hello.Client = "snake-client"
+	err = c.WriteJSON(hello)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	var welcome struct {
+		api.Welcome
+		Error string `json:"error"`
+	}
+	err = c.ReadJSON(&welcome)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if welcome.Status != api.GameStatusWelcome {
+		c.Close()
+		return nil, fmt.Errorf("rejected by the server: %s", welcome.Error)
+	}
+	codec, err := api.NewCodec(welcome.Encoding)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	log.Printf("connected to gameserver %s (commit %s), encoding: %s", welcome.Server.Version, welcome.Server.Commit, welcome.Encoding)
+	conn.keepalive(c, time.Duration(welcome.PingInterval)*time.Millisecond)
+
+	conn.mu.Lock()
+	conn.codec = codec
+	conn.Server = welcome.Server
+	conn.mu.Unlock()
+	return c, nil
+}
+
+// resume reconnects with the token within the grace the server gave.
+// It returns nil if the connection is closed on purpose or the server does not accept it.
+func (conn *Conn) resume(addr string) *websocket.Conn {
+	conn.mu.Lock()
+	closing := conn.closing
+	conn.mu.Unlock()
+	if closing || conn.Token == "" {
+		return nil
+	}
+
+	deadline := time.Now().Add(conn.Grace)
+	for time.Now().Before(deadline) {
+		// the server resumes only with the options of the session
+		c, err := conn.dial(addr, &api.Hello{Resume: conn.Token, Delta: true})
+		if err == nil {
+			conn.mu.Lock()
+			conn.conn = c
+			conn.mu.Unlock()
+			return c
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return nil
+}
+
 // AddHandler adds a handler when server response is received.
 func (conn *Conn) AddHandler(handler int, fn func([]byte) error) {
 	conn.funcMap[handler] = fn
@@ -122,10 +337,21 @@ func (conn *Conn) AddHandler(handler int, fn func([]byte) error) {
 // CloseWebSocket closes disconnects to server.
 // It is called when you exit ingame.
 func (conn *Conn) Close() {
-	conn.webDone <- struct{}{}
+	conn.mu.Lock()
+	conn.closing = true
+	lost := conn.lost
+	conn.mu.Unlock()
+	select {
+	case conn.webDone <- struct{}{}:
+	case <-lost:
+		// Connect has already returned
+		return
+	}
 
 	// TODO: Does it exist other good way? (ex. wait for server response)
 	time.Sleep(300 * time.Millisecond)
 
+	conn.mu.Lock()
 	conn.conn.Close()
+	conn.mu.Unlock()
 }
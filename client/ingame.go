@@ -3,74 +3,160 @@ package main
 import (
 	"fmt"
 	"image/color"
+	"log"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+	"github.com/hajimehoshi/ebiten/v2/text"
+	"github.com/myoan/snake/api"
 )
 
 const (
-	cellWidth  = 10
-	cellHeight = 10
-	borderLen  = 2
+	borderLen = 2
 )
 
+// itemColors are the colors of items spawned besides apples
+var itemColors = map[int]color.RGBA{
+	api.CellItemGrow:       {0x66, 0xff, 0x66, 0xff},
+	api.CellItemShrink:     {0xff, 0x66, 0xff, 0xff},
+	api.CellItemSpeed:      {0xff, 0xd7, 0x00, 0xff},
+	api.CellItemGhost:      {0x99, 0xcc, 0xff, 0xff},
+	api.CellItemMultiplier: {0xff, 0x99, 0x33, 0xff},
+}
+
+// snakeColors are the colors of other players' snakes, picked in order of players
+var snakeColors = []color.RGBA{
+	{0xff, 0xff, 0xff, 0xff},
+	{0xff, 0xd7, 0x00, 0xff},
+	{0xff, 0x66, 0xff, 0xff},
+	{0x66, 0xff, 0x66, 0xff},
+	{0xff, 0x99, 0x33, 0xff},
+}
+
 type Board struct {
-	board    [][]int
+	board [][]int
+	// owner is the ID of the player who owns each cell
+	owner    [][]string
 	width    int
 	height   int
 	widthPx  int
 	heightPx int
+	cellPx   int
+	colors   map[string]color.RGBA
+	// teams are the colors of teams by ID, which override the colors of snakes in a team match
+	teams map[int]color.RGBA
 }
 
 func NewBoard(w, h, wpx, hpx int) (*Board, error) {
-	if w > wpx || h > hpx {
+	// each cell is a square which fits the board into the screen
+	cellPx := wpx / w
+	if hpx/h < cellPx {
+		cellPx = hpx / h
+	}
+	cellPx -= borderLen
+	if cellPx < 1 {
 		return nil, fmt.Errorf("cell size too short (it requires more than 1px)")
 	}
 	board := make([][]int, h)
+	owner := make([][]string, h)
 	for i := range board {
 		board[i] = make([]int, w)
+		owner[i] = make([]string, w)
 	}
 
 	return &Board{
 		board:    board,
+		owner:    owner,
 		width:    w,
 		height:   h,
 		widthPx:  wpx,
 		heightPx: hpx,
+		cellPx:   cellPx,
 	}, nil
 }
 
-func (b *Board) Update(raw []int) {
+// SetTeams sets the colors of the teams in the config.
+func (b *Board) SetTeams(teams []api.TeamConfig) {
+	b.teams = make(map[int]color.RGBA)
+	for _, t := range teams {
+		c, err := parseColor(t.Color)
+		if err != nil {
+			log.Printf("team %d: %v", t.ID, err)
+			continue
+		}
+		b.teams[t.ID] = c
+	}
+}
+
+// parseColor parses a color in "#rrggbb".
+func parseColor(s string) (color.RGBA, error) {
+	c := color.RGBA{A: 0xff}
+	_, err := fmt.Sscanf(s, "#%02x%02x%02x", &c.R, &c.G, &c.B)
+	if err != nil {
+		return c, fmt.Errorf("invalid color '%s': %v", s, err)
+	}
+	return c, nil
+}
+
+func (b *Board) Update(raw []int, players []api.PlayerResponse) {
 	width := b.width
 	height := b.height
 	for i := 0; i < height; i++ {
 		for j := 0; j < width; j++ {
 			b.board[i][j] = raw[i*width+j]
+			b.owner[i][j] = ""
 		}
 	}
+	for _, p := range players {
+		for _, c := range p.Body {
+			b.owner[c.Y][c.X] = p.ID
+		}
+	}
+	b.colors = make(map[string]color.RGBA)
+	for i, p := range players {
+		if c, ok := b.teams[p.Team]; ok {
+			b.colors[p.ID] = c
+			continue
+		}
+		b.colors[p.ID] = snakeColors[i%len(snakeColors)]
+	}
 }
 
-func (b *Board) Draw(screen *ebiten.Image, me Snake) {
-	baseX := (screen.Bounds().Max.X - (cellWidth+borderLen)*b.width) / 2
-	baseY := (screen.Bounds().Max.Y - (cellHeight+borderLen)*b.height) / 2
+func (b *Board) Draw(screen *ebiten.Image, me Snake, myID string) {
+	cellPx := float64(b.cellPx)
+	baseX := (screen.Bounds().Max.X - (b.cellPx+borderLen)*b.width) / 2
+	baseY := (screen.Bounds().Max.Y - (b.cellPx+borderLen)*b.height) / 2
 	for y, row := range b.board {
 		for x, cell := range row {
 			gray := color.RGBA{0x30, 0x30, 0x30, 0xff}
 			apple := color.RGBA{0xff, 0x30, 0x30, 0xff}
-			snake := color.RGBA{0xff, 0xff, 0xff, 0xff}
+			wall := color.RGBA{0x66, 0x66, 0x99, 0xff}
+			snake, ok := b.colors[b.owner[y][x]]
+			if !ok {
+				snake = snakeColors[0]
+			}
 			mySnake := color.RGBA{0x00, 0xff, 0xff, 0xff}
-			px := baseX + (cellWidth+borderLen)*x
-			py := baseY + (cellHeight+borderLen)*y
-
-			if cell == -1 {
-				ebitenutil.DrawRect(screen, float64(px), float64(py), cellWidth, cellHeight, apple)
-			} else if cell == 0 {
-				ebitenutil.DrawRect(screen, float64(px), float64(py), cellWidth, cellHeight, gray)
+			myBody := color.RGBA{0x00, 0x99, 0x99, 0xff}
+			px := baseX + (b.cellPx+borderLen)*x
+			py := baseY + (b.cellPx+borderLen)*y
+
+			if cell == api.CellWall {
+				ebitenutil.DrawRect(screen, float64(px), float64(py), cellPx, cellPx, wall)
+			} else if cell == api.CellApple {
+				ebitenutil.DrawRect(screen, float64(px), float64(py), cellPx, cellPx, apple)
+			} else if item, ok := itemColors[cell]; ok {
+				ebitenutil.DrawRect(screen, float64(px), float64(py), cellPx, cellPx, item)
+			} else if cell == api.CellEmpty {
+				ebitenutil.DrawRect(screen, float64(px), float64(py), cellPx, cellPx, gray)
 			} else {
+				// in a team match, the body of the player is in the color of the team, and only the head stands out
 				if me.Head(x, y) {
-					ebitenutil.DrawRect(screen, float64(px), float64(py), cellWidth, cellHeight, mySnake)
+					ebitenutil.DrawRect(screen, float64(px), float64(py), cellPx, cellPx, mySnake)
+				} else if b.owner[y][x] == myID && len(b.teams) == 0 {
+					ebitenutil.DrawRect(screen, float64(px), float64(py), cellPx, cellPx, myBody)
 				} else {
-					ebitenutil.DrawRect(screen, float64(px), float64(py), cellWidth, cellHeight, snake)
+					ebitenutil.DrawRect(screen, float64(px), float64(py), cellPx, cellPx, snake)
 				}
 			}
 		}
@@ -89,7 +175,16 @@ func (s *IngameScene) Start() {
 }
 
 func (s *IngameScene) Update() (SceneType, error) {
-	if dir, changed := game.Snake.GetDirection(); changed {
+	if game.Status == StatusResult {
+		if inpututil.IsKeyJustPressed(ebiten.KeyEnter) {
+			go game.conn.SendRestart()
+			game.Status = StatusWait
+			return SceneType("matchmaking"), nil
+		}
+		if inpututil.IsKeyJustPressed(ebiten.KeyEscape) {
+			game.Status = StatusDrop
+		}
+	} else if dir, changed := game.Snake.GetDirection(); changed {
 		game.conn.SendDirection(dir)
 	}
 
@@ -100,10 +195,22 @@ func (s *IngameScene) Update() (SceneType, error) {
 }
 
 func (s *IngameScene) Finish() {
+	// the connection is kept while waiting for a rematch
+	if game.Status == StatusWait {
+		return
+	}
 	game.Status = StatusDrop
 	game.conn.Close()
 }
 
 func (s *IngameScene) Draw(screen *ebiten.Image) {
-	game.board.Draw(screen, game.Snake)
+	game.board.Draw(screen, game.Snake, game.UUID)
+	if game.Status == StatusResult {
+		str := fmt.Sprintf("Rank: %d\nScore: %d\nEnter: rematch\nEsc: menu", game.Rank, game.Score)
+		if game.Team > 0 {
+			// players share the rank of their team
+			str = fmt.Sprintf("Team %d\n%s", game.Team, str)
+		}
+		text.Draw(screen, str, mplusNormalFont, 30, screenHeight/2, color.White)
+	}
 }
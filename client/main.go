@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -19,18 +18,27 @@ func init() {
 const (
 	screenWidth  = 500
 	screenHeight = 500
-	Width        = 40
-	Height       = 40
 )
 
 type Game struct {
 	sceneMng *SceneManager
 	conn     *Conn
 	board    *Board
+	Config   api.GameConfig
 	Status   int
 	UUID     string
 	Score    int
-	Snake    Snake
+	// Rank is the rank in the last match. 0 means no result.
+	Rank int
+	// Team is the team of the player in the last match. 0 means no team.
+	Team  int
+	Snake Snake
+	// frame is the last frame, to which delta frames are applied
+	frame api.ResponseBody
+	// Notice tells the player why the last match ended unexpectedly
+	Notice string
+	// Waiting is the matchmaking state told by the server
+	Waiting api.WaitingBody
 }
 
 func (g *Game) Update() error {
@@ -50,11 +58,15 @@ var game *Game
 func main() {
 	var addr string
 	var npc bool
+	var spectate bool
 	flag.StringVar(&addr, "addr", "localhost:8080", "http service address")
 	flag.BoolVar(&npc, "npc", false, "execute as NPC")
+	flag.BoolVar(&spectate, "spectate", false, "watch a match without playing")
+	encoding := flag.String("encoding", api.EncodingBinary, "preferred encoding of frames (json, binary)")
+	room := flag.String("room", "", "name of the room to join, which is created if it does not exist")
+	code := flag.String("code", "", "join code of the room, which makes a new room private")
 	flag.Parse()
 
-	board, _ := NewBoard(Width, Height, 500, 500)
 	var snake Snake
 
 	if npc {
@@ -65,32 +77,43 @@ func main() {
 
 	game = &Game{
 		sceneMng: NewSceneManager(),
-		conn:     NewConn(),
+		conn:     NewConn(*encoding),
 		Status:   StatusInit,
-		board:    board,
 		UUID:     "-",
 		Snake:    snake,
 	}
+	game.conn.SetRoom(*room, *code)
 
-	game.sceneMng.AddScene("menu", NewMenuScene(addr))
+	game.sceneMng.AddScene("menu", NewMenuScene(addr, spectate))
 	game.sceneMng.AddScene("matchmaking", NewMatchmakingScene())
 	game.sceneMng.AddScene("ingame", NewIngameScene(screenWidth, screenHeight))
 
 	game.sceneMng.SetInitialScene("menu")
 	game.conn.AddHandler(api.GameStatusInit, func(message []byte) error {
 		var resp api.InitResponse
-		err := json.Unmarshal(message, &resp)
+		err := game.conn.Unmarshal(message, &resp)
+		if err != nil {
+			return err
+		}
+		board, err := NewBoard(resp.Config.Width, resp.Config.Height, screenWidth, screenHeight)
 		if err != nil {
 			return err
 		}
 		game.conn.UUID = resp.ID
+		game.conn.Token = resp.Token
+		game.conn.Grace = time.Duration(resp.Config.ResumeGrace) * time.Second
 		game.UUID = resp.ID
+		game.Config = resp.Config
+		game.board = board
+		game.board.SetTeams(resp.Config.Teams)
+		// frames may be lost while the connection dropped, so wait for a keyframe
+		game.frame = api.ResponseBody{}
 		game.Snake.SetUUID(resp.ID)
 		return nil
 	})
 	game.conn.AddHandler(api.GameStatusOK, func(message []byte) error {
 		var resp api.EventResponse
-		err := json.Unmarshal(message, &resp)
+		err := game.conn.Unmarshal(message, &resp)
 		if err != nil {
 			return err
 		}
@@ -98,12 +121,28 @@ func main() {
 			game.Status = StatusStart
 		}
 		game.Snake.Update(resp.Body.Board, resp.Body.Players)
-		game.board.Update(resp.Body.Board)
+		game.board.Update(resp.Body.Board, resp.Body.Players)
+		game.frame = resp.Body
+		return nil
+	})
+	game.conn.AddHandler(api.GameStatusDelta, func(message []byte) error {
+		var resp api.DeltaResponse
+		err := game.conn.Unmarshal(message, &resp)
+		if err != nil {
+			return err
+		}
+		// a delta frame can not be applied until the first keyframe arrives
+		if game.frame.Board == nil {
+			return nil
+		}
+		game.frame.ApplyDelta(resp.Body)
+		game.Snake.Update(game.frame.Board, game.frame.Players)
+		game.board.Update(game.frame.Board, game.frame.Players)
 		return nil
 	})
 	game.conn.AddHandler(api.GameStatusError, func(message []byte) error {
 		var resp api.EventResponse
-		err := json.Unmarshal(message, &resp)
+		err := game.conn.Unmarshal(message, &resp)
 		if err != nil {
 			return err
 		}
@@ -111,16 +150,49 @@ func main() {
 		game.Status = StatusDrop
 		for _, p := range resp.Body.Players {
 			if p.ID == game.UUID {
-				game.Score = p.Size
+				game.Score = p.Score
+				break
+			}
+		}
+		log.Printf("error from the server: %s", resp.Error)
+		game.Notice = resp.Error
+		return fmt.Errorf("error: %s", resp.Error)
+	})
+	game.conn.AddHandler(api.GameStatusFinished, func(message []byte) error {
+		var resp api.ResultResponse
+		err := game.conn.Unmarshal(message, &resp)
+		if err != nil {
+			return err
+		}
+
+		// stay connected, so that the player can ask for a rematch
+		game.Status = StatusResult
+		for _, s := range resp.Body.Standings {
+			if s.ID == game.UUID {
+				game.Score = s.Score
+				game.Rank = s.Rank
+				game.Team = s.Team
 				break
 			}
 		}
-		return fmt.Errorf("error")
+		return nil
 	})
 	game.conn.AddHandler(api.GameStatusWaiting, func(message []byte) error {
+		var resp api.WaitingResponse
+		err := game.conn.Unmarshal(message, &resp)
+		if err != nil {
+			return err
+		}
+
 		game.Status = StatusWait
+		game.Waiting = resp.Body
 		return nil
 	})
+	game.conn.SetLostHandler(func(err error) {
+		log.Printf("connection lost: %v", err)
+		game.Notice = fmt.Sprintf("Connection lost: %v", err)
+		game.Status = StatusDrop
+	})
 
 	ebiten.SetWindowSize(screenWidth, screenHeight)
 	ebiten.SetWindowTitle("Snake Game")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"image/color"
 
 	"github.com/hajimehoshi/ebiten/v2"
@@ -32,6 +33,9 @@ func (s *MatchmakingScene) Update() (SceneType, error) {
 	if game.Status == StatusStart {
 		return SceneType("ingame"), nil
 	}
+	if game.Status == StatusDrop {
+		return SceneType("menu"), nil
+	}
 	return SceneType("matchmaking"), nil
 }
 
@@ -46,5 +50,14 @@ func (s *MatchmakingScene) Draw(screen *ebiten.Image) {
 	for i := 0; i < s.dotNum; i++ {
 		str += "."
 	}
+	if w := game.Waiting; w.MaxPlayers > 0 {
+		str += fmt.Sprintf("\nPlayers: %d/%d", w.Players, w.MaxPlayers)
+		if w.Needed > 0 {
+			str += fmt.Sprintf("\nNeed %d more", w.Needed)
+		}
+		if w.SecondsLeft > 0 {
+			str += fmt.Sprintf("\nStarting in %ds", w.SecondsLeft)
+		}
+	}
 	text.Draw(screen, str, mplusNormalFont, x, y, color.White)
 }
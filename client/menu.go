@@ -9,6 +9,7 @@ import (
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/inpututil"
 	"github.com/hajimehoshi/ebiten/v2/text"
+	"github.com/myoan/snake/api"
 	"golang.org/x/image/font"
 	"golang.org/x/image/font/opentype"
 )
@@ -33,20 +34,25 @@ func init() {
 	}
 }
 
-func NewMenuScene(addr string) *MenuScene {
+func NewMenuScene(addr string, spectate bool) *MenuScene {
 	return &MenuScene{
-		addr: addr,
+		addr:     addr,
+		spectate: spectate,
 	}
 }
 
 type MenuScene struct {
-	addr string
+	addr     string
+	spectate bool
 }
 
 func (s *MenuScene) Start() {}
 func (s *MenuScene) Update() (SceneType, error) {
 	if inpututil.IsKeyJustPressed(ebiten.KeyEnter) {
-		go game.conn.Connect(s.addr)
+		game.Status = StatusInit
+		game.Notice = ""
+		game.Waiting = api.WaitingBody{}
+		go game.conn.Connect(s.addr, s.spectate)
 		return SceneType("matchmaking"), nil
 	}
 	return SceneType("menu"), nil
@@ -55,6 +61,12 @@ func (s *MenuScene) Finish() {}
 
 func (s *MenuScene) Draw(screen *ebiten.Image) {
 	str := fmt.Sprintf("ID: %s\nScore: %d\nPress Enter", game.UUID, game.Score)
+	if game.Rank > 0 {
+		str = fmt.Sprintf("ID: %s\nRank: %d\nScore: %d\nPress Enter", game.UUID, game.Rank, game.Score)
+	}
+	if game.Notice != "" {
+		str += "\n\n" + game.Notice
+	}
 	b := text.BoundString(mplusNormalFont, "Menu")
 	x := 30
 	y := (screen.Bounds().Max.Y - b.Dy()) / 2
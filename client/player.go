@@ -81,21 +81,24 @@ func (p *NonPlayer) Update(board []int, players []api.PlayerResponse) {
 
 	fixed := false
 
-	if p.x == 1 && p.dir == DirectionLeft {
-		p.dir = DirectionDown
-		fixed = true
-	}
-	if p.x == Width-2 && p.dir == DirectionRight {
-		p.dir = DirectionUp
-		fixed = true
-	}
-	if p.y == 1 && p.dir == DirectionUp {
-		p.dir = DirectionLeft
-		fixed = true
-	}
-	if p.y == Height-2 && p.dir == DirectionDown {
-		p.dir = DirectionRight
-		fixed = true
+	// turn before walls, which are only on the board of wall topology
+	if game.Config.Topology != api.TopologyTorus {
+		if p.x == 1 && p.dir == DirectionLeft {
+			p.dir = DirectionDown
+			fixed = true
+		}
+		if p.x == game.Config.Width-2 && p.dir == DirectionRight {
+			p.dir = DirectionUp
+			fixed = true
+		}
+		if p.y == 1 && p.dir == DirectionUp {
+			p.dir = DirectionLeft
+			fixed = true
+		}
+		if p.y == game.Config.Height-2 && p.dir == DirectionDown {
+			p.dir = DirectionRight
+			fixed = true
+		}
 	}
 
 	if !fixed {
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"net/url"
 	"time"
 
@@ -34,13 +35,21 @@ type UserInterface struct {
 	funcMap  map[int]func([]byte) error
 	Score    int
 	UUID     string
+	Config   api.GameConfig
+	// encoding is the encoding the client prefers
+	encoding string
+	// codec encodes requests and decodes frames in the encoding the server chose
+	codec api.Codec
+	// pongWait is how long the client waits for anything from the server before it regards the server as dead
+	pongWait time.Duration
+	closing  bool
 }
 
 // NewUserInterface creates a new UserInterface.
 // You must call this method before using the UserInterface.
 // UserInterface is listening user controlle events and sends them to the event channel.
 // webEvent is a channel for sending to web server.
-func NewUserInterface(uuid string, event chan<- engine.ControlEvent, webEvent chan engine.ControlEvent) *UserInterface {
+func NewUserInterface(uuid string, event chan<- engine.ControlEvent, webEvent chan engine.ControlEvent, encoding string) *UserInterface {
 	done := make(chan struct{})
 	fm := make(map[int]func([]byte) error)
 
@@ -51,10 +60,17 @@ func NewUserInterface(uuid string, event chan<- engine.ControlEvent, webEvent ch
 		webEvent: webEvent,
 		webDone:  done,
 		funcMap:  fm,
+		encoding: encoding,
+		codec:    api.JSONCodec{},
 	}
 	return ui
 }
 
+// Unmarshal decodes the frame given to handlers.
+func (ui *UserInterface) Unmarshal(data []byte, v interface{}) error {
+	return ui.codec.Unmarshal(data, v)
+}
+
 // Finish is called when the entire game is over.
 func (ui *UserInterface) Finish() {}
 
@@ -67,34 +83,50 @@ func (ui *UserInterface) AddHandler(handler int, fn func([]byte) error) {
 // It connects when ingame is started.
 // So, it is recreate connections if you play ingame multiple times.
 func (ui *UserInterface) ConnectWebSocket() {
-	u := url.URL{Scheme: "ws", Host: *addr, Path: "/ingame"}
-
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	c, err := ui.dial()
 	if err != nil {
 		log.Printf("dial: %v", err)
 		return
 	}
 	ui.conn = c
+	ui.closing = false
+	mt := websocket.TextMessage
+	if ui.codec.Binary() {
+		mt = websocket.BinaryMessage
+	}
 
 	go func() {
 		for {
 			_, message, err := c.ReadMessage()
 			if err != nil {
 				log.Println("read:", err)
+				if ui.closing {
+					return
+				}
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					log.Printf("server is not responding for %v", ui.pongWait)
+				}
+				log.Println("connection lost")
+				ui.Status = StatusDrop
 				return
 			}
-			var resp map[string]interface{}
-			err = json.Unmarshal(message, &resp)
+			if ui.pongWait > 0 {
+				c.SetReadDeadline(time.Now().Add(ui.pongWait))
+			}
+			status, err := ui.codec.Status(message)
 			if err != nil {
 				log.Println("unmarshal:", err)
 				return
 			}
-			fstatus := resp["status"].(float64)
-			istatus := int(fstatus)
 
-			err = ui.funcMap[istatus](message)
+			fn, ok := ui.funcMap[status]
+			if !ok {
+				log.Printf("unknown status %d", status)
+				continue
+			}
+			err = fn(message)
 			if err != nil {
-				log.Printf("return from ConnectWebsocket read handler: %d", istatus)
+				log.Printf("return from ConnectWebsocket read handler: %d", status)
 				return
 			}
 		}
@@ -108,8 +140,8 @@ func (ui *UserInterface) ConnectWebSocket() {
 				Eventtype: ctrl.Eventtype,
 				Key:       ctrl.Key,
 			}
-			bytes, _ := json.Marshal(&event)
-			err := c.WriteMessage(websocket.TextMessage, bytes)
+			bytes, _ := ui.codec.Marshal(event)
+			err := c.WriteMessage(mt, bytes)
 			if err != nil {
 				log.Println("write:", err)
 				return
@@ -131,9 +163,75 @@ func (ui *UserInterface) ConnectWebSocket() {
 	}
 }
 
+// dial connects to server and exchanges the hello and the welcome.
+// The server rejects an incompatible client with the reason.
+func (ui *UserInterface) dial() (*websocket.Conn, error) {
+	u := url.URL{Scheme: "ws", Host: *addr, Path: "/ingame"}
+	if *room != "" {
+		q := url.Values{}
+		q.Set(api.QueryRoom, *room)
+		if *code != "" {
+			q.Set(api.QueryCode, *code)
+		}
+		u.RawQuery = q.Encode()
+	}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hello := &api.Hello{
+		Version:   api.ProtocolVersion,
+		Encodings: []string{ui.encoding, api.EncodingJSON},
+		Client:    "snake-console",
+	}
+	err = c.WriteJSON(hello)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	var welcome struct {
+		api.Welcome
+		Error string `json:"error"`
+	}
+	err = c.ReadJSON(&welcome)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if welcome.Status != api.GameStatusWelcome {
+		c.Close()
+		return nil, fmt.Errorf("rejected by the server: %s", welcome.Error)
+	}
+	codec, err := api.NewCodec(welcome.Encoding)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	log.Printf("connected to gameserver %s (commit %s), encoding: %s", welcome.Server.Version, welcome.Server.Commit, welcome.Encoding)
+	ui.codec = codec
+	ui.keepalive(c, time.Duration(welcome.PingInterval)*time.Millisecond)
+	return c, nil
+}
+
+// keepalive answers pings of the server, and makes reads fail if the server sends nothing for a few ping intervals.
+func (ui *UserInterface) keepalive(c *websocket.Conn, interval time.Duration) {
+	ui.pongWait = 3 * interval
+	if ui.pongWait <= 0 {
+		return
+	}
+	c.SetReadDeadline(time.Now().Add(ui.pongWait))
+	c.SetPingHandler(func(data string) error {
+		c.SetReadDeadline(time.Now().Add(ui.pongWait))
+		return c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+}
+
 // CloseWebSocket closes disconnects to server.
 // It is called when you exit ingame.
 func (ui *UserInterface) CloseWebSocket() {
+	ui.closing = true
 	ui.webDone <- struct{}{}
 
 	// TODO: Does it exist other good way? (ex. wait for server response)
@@ -154,16 +252,21 @@ func (ui *UserInterface) Update(players []api.PlayerResponse) {
 		}
 	}
 
+	// no walls to avoid on a torus board
+	if ui.Config.Topology == api.TopologyTorus {
+		return
+	}
+
 	if x == 3 && dir == DirectionLeft {
 		ui.webEvent <- engine.ControlEvent{Eventtype: 0, Key: api.MoveDown}
 	}
-	if x == Width-4 && dir == DirectionRight {
+	if x == ui.Config.Width-4 && dir == DirectionRight {
 		ui.webEvent <- engine.ControlEvent{Eventtype: 0, Key: api.MoveUp}
 	}
 	if y == 3 && dir == DirectionUp {
 		ui.webEvent <- engine.ControlEvent{Eventtype: 0, Key: api.MoveLeft}
 	}
-	if y == Height-4 && dir == DirectionDown {
+	if y == ui.Config.Height-4 && dir == DirectionDown {
 		ui.webEvent <- engine.ControlEvent{Eventtype: 0, Key: api.MoveRight}
 	}
 }
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -11,9 +10,6 @@ import (
 )
 
 const (
-	Width  = 40
-	Height = 40
-
 	SceneTypeNone engine.SceneType = iota
 	SceneTypeMenu
 	SceneTypeMatchmaking
@@ -27,6 +23,9 @@ const (
 type Board struct{}
 
 var addr = flag.String("addr", "localhost:8080", "http service address")
+var encoding = flag.String("encoding", api.EncodingBinary, "preferred encoding of frames (json, binary)")
+var room = flag.String("room", "", "name of the room to join, which is created if it does not exist")
+var code = flag.String("code", "", "join code of the room, which makes a new room private")
 
 func main() {
 	log.Printf("========== GAME START ==========")
@@ -41,22 +40,23 @@ func main() {
 	event := ge.GetEventStream()
 	webEvent := make(chan engine.ControlEvent)
 
-	ui := NewUserInterface("noname", event, webEvent)
+	ui := NewUserInterface("noname", event, webEvent, *encoding)
 
 	ui.AddHandler(api.GameStatusInit, func(message []byte) error {
-		log.Printf("get init response: %s", string(message))
+		log.Printf("get init response: %d bytes", len(message))
 		var resp api.InitResponse
-		err := json.Unmarshal(message, &resp)
+		err := ui.Unmarshal(message, &resp)
 		if err != nil {
 			log.Println("unmarshal:", err)
 			return err
 		}
 		ui.UUID = resp.ID
+		ui.Config = resp.Config
 		return nil
 	})
 	ui.AddHandler(api.GameStatusOK, func(message []byte) error {
 		var resp api.EventResponse
-		err = json.Unmarshal(message, &resp)
+		err := ui.Unmarshal(message, &resp)
 		if err != nil {
 			log.Println("unmarshal:", err)
 			return err
@@ -69,24 +69,59 @@ func main() {
 	})
 	ui.AddHandler(api.GameStatusError, func(message []byte) error {
 		var resp api.EventResponse
-		err = json.Unmarshal(message, &resp)
+		err := ui.Unmarshal(message, &resp)
 		if err != nil {
 			log.Println("unmarshal:", err)
 			return err
 		}
 
-		log.Printf("return from ConnectWebsocket read handler: %d", api.GameStatusError)
+		log.Printf("return from ConnectWebsocket read handler: %d (%s)", api.GameStatusError, resp.Error)
 		ui.Status = StatusDrop
 		for _, p := range resp.Body.Players {
 			if p.ID == ui.UUID {
-				ui.Score = p.Size
+				ui.Score = p.Score
 				break
 			}
 		}
 		return fmt.Errorf("error")
 	})
+	ui.AddHandler(api.GameStatusFinished, func(message []byte) error {
+		var resp api.ResultResponse
+		err := ui.Unmarshal(message, &resp)
+		if err != nil {
+			log.Println("unmarshal:", err)
+			return err
+		}
+
+		ui.Status = StatusDrop
+		for _, s := range resp.Body.Standings {
+			log.Printf("#%d %s length: %d, kills: %d, survival: %d ticks", s.Rank, s.ID, s.Length, s.Kills, s.SurvivalTicks)
+			if s.ID == ui.UUID {
+				ui.Score = s.Score
+			}
+		}
+		for _, t := range resp.Body.Teams {
+			log.Printf("#%d team %d combined length: %d", t.Rank, t.Team, t.Length)
+		}
+		return fmt.Errorf("finished")
+	})
 	ui.AddHandler(api.GameStatusWaiting, func(message []byte) error {
-		log.Printf("Receive waiting event")
+		var resp api.WaitingResponse
+		err := ui.Unmarshal(message, &resp)
+		if err != nil {
+			log.Println("unmarshal:", err)
+			return err
+		}
+
+		w := resp.Body
+		switch {
+		case w.SecondsLeft > 0:
+			log.Printf("waiting: %d/%d players, starting in %ds", w.Players, w.MaxPlayers, w.SecondsLeft)
+		case w.Needed > 0:
+			log.Printf("waiting: %d/%d players, need %d more", w.Players, w.MaxPlayers, w.Needed)
+		default:
+			log.Printf("waiting: %d/%d players", w.Players, w.MaxPlayers)
+		}
 		return nil
 	})
 
@@ -3,6 +3,16 @@ import 'phaser';
 const WINDOW_WIDTH = 1200;
 const WINDOW_HEIGHT = 1000;
 const CELL_PX = 16;
+const CELL_APPLE = -1;
+const CELL_WALL = -2;
+// items spawned besides apples: grow, shrink, speed, ghost and multiplier
+const ITEM_COLORS = {
+  [-3]: 0x66ff66,
+  [-4]: 0xff66ff,
+  [-5]: 0xffd700,
+  [-6]: 0x99ccff,
+  [-7]: 0xff9933,
+};
 
 export class Board {
   scene: Phaser.Scene;
@@ -52,8 +62,12 @@ export class Board {
         this.raw[i][j] = data[i][j]
         const x = xPad + j * (CELL_PX+4);
         const y = yPad + i * (CELL_PX+4);
-        if (this.raw[i][j] < 0) {
+        if (this.raw[i][j] == CELL_WALL) {
+          this.scene.add.rectangle(x, y, CELL_PX, CELL_PX, 0x666699);
+        } else if (this.raw[i][j] == CELL_APPLE) {
           this.scene.add.rectangle(x, y, CELL_PX, CELL_PX, 0xff9999);
+        } else if (this.raw[i][j] < 0) {
+          this.scene.add.rectangle(x, y, CELL_PX, CELL_PX, ITEM_COLORS[this.raw[i][j]]);
         } else if (this.raw[i][j] > 0) {
           this.scene.add.rectangle(x, y, CELL_PX, CELL_PX, 0xcccccc);
         } else {
@@ -1,7 +1,5 @@
 import Board from '../game/Board';
-
-const SCREEN_WIDTH_CELL = 40;
-const SCREEN_HEIGHT_CELL = 40;
+import { hello } from './Preloader';
 
 const MOVE_LEFT = 0;
 const MOVE_RIGHT = 1;
@@ -17,7 +15,7 @@ function arrayTo2DArray(arry: integer[], width: integer, height: integer): integ
   }
   for (let i = 0; i < height; i++) {
     for (let j = 0; j < width; j++) {
-      result[i][j] = arry[i*height + j]
+      result[i][j] = arry[i*width + j]
     }
   }
   return result
@@ -26,6 +24,16 @@ export default class Game extends Phaser.Scene {
   id: String;
   board: Board;
   conn: WebSocket;
+  width: integer;
+  height: integer;
+  url: string;
+  // token resumes the session after the connection dropped
+  token: string;
+  resumeDeadline: number;
+  resumeGrace: number;
+  finished: boolean;
+  // cells is the board of the last frame, to which delta frames are applied
+  cells: integer[];
   constructor(conn: WebSocket) {
     super('game')
   }
@@ -33,31 +41,101 @@ export default class Game extends Phaser.Scene {
   create(args) {
     var id = args[0];
     var conn = args[1];
+    var config = args[2];
     this.id = id;
     this.conn = conn;
-    this.board = new Board(this, SCREEN_WIDTH_CELL, SCREEN_HEIGHT_CELL);
-    const initArray = new Array(SCREEN_HEIGHT_CELL * SCREEN_WIDTH_CELL).fill(0);
-    this.board.draw(arrayTo2DArray(initArray, SCREEN_WIDTH_CELL, SCREEN_HEIGHT_CELL), true);
+    this.width = config.width;
+    this.height = config.height;
+    this.url = args[3];
+    this.token = args[4];
+    this.resumeGrace = (config.resume_grace || 0) * 1000;
+    this.finished = false;
+    this.resumeDeadline = 0;
+    // the first keyframe was received by the preloader
+    this.cells = args[5] || null;
+    this.board = new Board(this, this.width, this.height);
+    const initArray = this.cells || new Array(this.height * this.width).fill(0);
+    this.board.draw(arrayTo2DArray(initArray, this.width, this.height), true);
 
     this.input.keyboard.on('keydown-W', () => { this.sendDirection(MOVE_UP) }, this)
     this.input.keyboard.on('keydown-A', () => { this.sendDirection(MOVE_LEFT) }, this)
     this.input.keyboard.on('keydown-S', () => { this.sendDirection(MOVE_DOWN) }, this)
     this.input.keyboard.on('keydown-D', () => { this.sendDirection(MOVE_RIGHT) }, this)
 
+    this.listen();
+  }
+
+  // listen handles frames of the connection, and resumes the session when the connection drops.
+  listen() {
+    this.conn.onclose = () => {
+      if (this.finished || !this.token) {
+        return;
+      }
+      if (!this.resumeDeadline) {
+        this.resumeDeadline = Date.now() + this.resumeGrace;
+      }
+      if (Date.now() > this.resumeDeadline) {
+        this.scene.start('preloader', [this.id, 0])
+        return;
+      }
+      console.log(`resume`)
+      setTimeout(() => {
+        this.conn = new WebSocket(this.url);
+        this.conn.onopen = () => {
+          this.conn.send(hello({ resume: this.token }));
+        };
+        this.listen();
+      }, 500);
+    };
+
     this.conn.onmessage = (event) => {
       const data = JSON.parse(event.data);
       switch(data.status) {
+        case 6: // GameStatusWelcome before resuming
+          break;
+
+        case 0: // GameStatusInit after resuming
+          this.resumeDeadline = 0;
+          // frames may be lost while the connection dropped
+          this.cells = null;
+          break;
+
         case 1: // GameStatusOk
           const body = data.body
-          this.board.draw(arrayTo2DArray(body.board, SCREEN_WIDTH_CELL, SCREEN_HEIGHT_CELL));
+          this.cells = body.board;
+          this.board.draw(arrayTo2DArray(body.board, this.width, this.height));
+          break;
+
+        case 5: // GameStatusDelta
+          // wait for a keyframe
+          if (!this.cells) {
+            break;
+          }
+          data.body.cells.forEach(c => {
+            this.cells[c.y*this.width + c.x] = c.value;
+          })
+          this.board.draw(arrayTo2DArray(this.cells, this.width, this.height));
           break;
 
         case 2: // GameStatusError
-          console.log(`dropped`)
+          console.log(`dropped: ${data.error}`)
+          this.finished = true;
           this.conn.close();
-          data.body.players.forEach(p => {
+          // a failed resume has no players
+          (data.body.players || []).forEach(p => {
             if (p.id == this.id) {
-              this.scene.start('preloader', [this.id, p.size])
+              this.scene.start('preloader', [this.id, p.score])
+            }
+          })
+          break;
+
+        case 4: // GameStatusFinished
+          console.log(`finished`)
+          this.finished = true;
+          this.conn.close();
+          data.body.standings.forEach(s => {
+            if (s.id == this.id) {
+              this.scene.start('preloader', [this.id, s.score, s.rank])
             }
           })
           break;
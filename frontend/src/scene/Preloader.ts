@@ -1,6 +1,18 @@
 import axios from 'axios';
 import 'phaser';
 
+// PROTOCOL_VERSION must match api.ProtocolVersion of the gameserver
+export const PROTOCOL_VERSION = 4;
+
+// hello is the first message to the gameserver, which is answered with the welcome
+export function hello(options: object = {}): string {
+  return JSON.stringify(Object.assign({
+    version: PROTOCOL_VERSION,
+    encodings: ['json'],
+    client: 'snake-frontend',
+  }, options));
+}
+
 let text: Phaser.GameObjects.Text;
 export default class Preloader extends Phaser.Scene {
   id: String;
@@ -8,6 +20,8 @@ export default class Preloader extends Phaser.Scene {
   conn: WebSocket;
   ip: string;
   port: integer;
+  config: any;
+  token: string;
 
   constructor(id: String, score: integer) {
     super('preloader');
@@ -16,11 +30,15 @@ export default class Preloader extends Phaser.Scene {
   create(args) {
     const id = args[0];
     const score = args[1] | 0;
+    const rank = args[2] | 0;
     const content = [
       `ID: ${id}`,
       `Score: ${score}`,
       "[ENTER] -> Game Start"
     ]
+    if (rank > 0) {
+      content.splice(1, 0, `Rank: ${rank}`)
+    }
     this.id = id;
 
     text = this.add.text(100, 100, content, { fontFamily: 'Arial', color: '#00ff00' });
@@ -29,9 +47,13 @@ export default class Preloader extends Phaser.Scene {
 
   connect() {
     const scene = this;
+    // ?room=name&code=secret joins the room of friends, and the code makes a new room private
+    const params = new URLSearchParams(window.location.search);
+    const room = params.get('room') || '';
+    const code = params.get('code') || '';
     console.log('get api.snake.game.myoan.dev/room');
 
-    axios.get('https://api.snake.game.myoan.dev/room')
+    axios.get('https://api.snake.game.myoan.dev/room', { params: room ? { name: room } : {} })
       .then(function (resp) {
         const data = resp.data;
 
@@ -39,25 +61,58 @@ export default class Preloader extends Phaser.Scene {
         scene.port = data.port;
 
         console.log("connect wss://" + scene.ip + ':' + scene.port);
-        scene.conn = new WebSocket('wss://' + scene.ip + ":" + scene.port + '/');
+        let url = 'wss://' + scene.ip + ":" + scene.port + '/';
+        if (data.room) {
+          const query = new URLSearchParams({ room: data.room });
+          if (code) {
+            query.set('code', code);
+          }
+          url += '?' + query.toString();
+        }
+        scene.conn = new WebSocket(url);
+        scene.conn.onopen = () => {
+          scene.conn.send(hello({ delta: true }));
+        };
 
         scene.conn.onmessage = (event) => {
           const data = JSON.parse(event.data);
           switch(data.status) {
+            case 2: // GameStatusError, such as an incompatible client
+              console.log(`rejected: ${data.error}`)
+              text.destroy();
+              text = scene.add.text(100, 100, `rejected: ${data.error}`, { fontFamily: 'Arial', color: '#ff0000' });
+              break;
+
+            case 6: // GameStatusWelcome
+              console.log(`gameserver ${data.server.version} (${data.server.commit})`)
+              break;
+
             case 0: // GameStatusInit
               scene.id = data.id
+              scene.config = data.config
+              scene.token = data.token
               break;
 
             case 1: // GameStatusOk
-              scene.scene.start('game', [scene.id, scene.conn])
+              // the first keyframe is the base of the following delta frames
+              scene.scene.start('game', [scene.id, scene.conn, scene.config, url, scene.token, data.body.board])
               break
 
-            case 3: // GameStatusWaiting...
-              console.log(`waiting ...`)
+            case 3: { // GameStatusWaiting...
+              const w = data.body;
+              let msg = `waiting... ${w.players}/${w.max_players} players`;
+              if (w.needed > 0) {
+                msg += `, need ${w.needed} more`;
+              }
+              if (w.seconds_left > 0) {
+                msg += `, starting in ${w.seconds_left}s`;
+              }
+              console.log(msg)
 
               text.destroy();
-              text = scene.add.text(100, 100, "waiting...", { fontFamily: 'Arial', color: '#00ff00' });
+              text = scene.add.text(100, 100, msg, { fontFamily: 'Arial', color: '#00ff00' });
               break;
+            }
 
             default:
               console.log(`data(${data.status}): ${data}`)
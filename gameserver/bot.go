@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/myoan/snake/api"
+)
+
+// Strategies of bots.
+const (
+	// BotRandom wanders without running into anything in front of it
+	BotRandom = "random"
+	// BotGreedy takes the shortest path to the nearest apple
+	BotGreedy = "greedy"
+	// BotSurvival avoids moves which trap the snake, and goes for apples when it is safe
+	BotSurvival = "survival"
+)
+
+// Difficulties of bots.
+const (
+	BotEasy   = "easy"
+	BotNormal = "normal"
+	BotHard   = "hard"
+)
+
+// difficulty tunes a bot regardless of its strategy.
+type difficulty struct {
+	// late is the chance to miss the turn of the tick and go straight
+	late float64
+	// cautious avoids cells which the head of another snake can reach in the same tick
+	cautious bool
+}
+
+var difficulties = map[string]difficulty{
+	BotEasy:   {late: 0.3},
+	BotNormal: {late: 0.1},
+	BotHard:   {cautious: true},
+}
+
+// Strategy decides where a bot goes.
+type Strategy interface {
+	// Next returns the direction of the snake in the next tick.
+	Next(v *botView, rng *rand.Rand) int
+}
+
+// NewStrategy returns the strategy of the name.
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case BotRandom:
+		return randomStrategy{}, nil
+	case BotGreedy:
+		return greedyStrategy{}, nil
+	case BotSurvival:
+		return survivalStrategy{}, nil
+	}
+	return nil, fmt.Errorf("unknown bot strategy '%s'", name)
+}
+
+// BotClient is an in-process player which fills a slot nobody else joins.
+// It receives frames and sends requests like a remote client, so the room treats it as any other player.
+// Frames are handled by Run, and only the latest frame is kept, so a bot never blocks the room.
+type BotClient struct {
+	id         string
+	stream     chan []byte
+	frames     chan []byte
+	done       chan struct{}
+	strategy   Strategy
+	difficulty difficulty
+	config     api.GameConfig
+	rng        *rand.Rand
+	observers  []Observer
+	closed     bool
+	mu         sync.Mutex
+}
+
+// NewBotClient creates a bot which plays by the strategy and the difficulty of the config.
+func NewBotClient(cfg *GameConfig) *BotClient {
+	strategy, err := NewStrategy(cfg.BotStrategy)
+	if err != nil {
+		// the config is validated on load
+		strategy = survivalStrategy{}
+	}
+	return &BotClient{
+		id:         "bot-" + uuid.NewString()[:8],
+		stream:     make(chan []byte),
+		frames:     make(chan []byte, 1),
+		done:       make(chan struct{}),
+		strategy:   strategy,
+		difficulty: difficulties[cfg.BotDifficulty],
+		config:     cfg.Protocol(),
+		rng:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (c *BotClient) ID() string {
+	return c.id
+}
+
+// Token is empty, because a bot never drops.
+func (c *BotClient) Token() string {
+	return ""
+}
+
+// Options asks for full binary frames, which are cheap to decode and need no delta state.
+func (c *BotClient) Options() ClientOptions {
+	return ClientOptions{Encoding: api.EncodingBinary}
+}
+
+func (c *BotClient) Latency() time.Duration {
+	return 0
+}
+
+func (c *BotClient) Stream() chan []byte {
+	return c.stream
+}
+
+func (c *BotClient) AddObserver(o Observer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.observers = append(c.observers, o)
+}
+
+// Send replaces the frame which the bot has not read yet, because only the latest frame matters.
+func (c *BotClient) Send(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errClientClosed
+	}
+	select {
+	case <-c.frames:
+	default:
+	}
+	c.frames <- data
+	return nil
+}
+
+// Close stops the bot, and notifies EventClientFinish only once.
+func (c *BotClient) Close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.done)
+	observers := append([]Observer{}, c.observers...)
+	c.mu.Unlock()
+
+	for _, o := range observers {
+		o.Update(TriggerArgument{
+			EventType: EventClientFinish,
+			Client:    c,
+		})
+	}
+}
+
+// Run plays until the bot is closed. The stream is closed when it returns.
+func (c *BotClient) Run() {
+	defer close(c.stream)
+	codec := c.Options().Codec()
+	for {
+		var data []byte
+		select {
+		case data = <-c.frames:
+		case <-c.done:
+			return
+		}
+
+		status, err := codec.Status(data)
+		if err != nil {
+			continue
+		}
+		var req *api.EventRequest
+		switch status {
+		case api.GameStatusOK:
+			var resp api.EventResponse
+			err = codec.Unmarshal(data, &resp)
+			if err != nil {
+				log.Printf("[Error] bot %s: %v", c.id, err)
+				continue
+			}
+			req = c.move(&resp)
+		case api.GameStatusFinished:
+			// bots are always up for a rematch
+			req = &api.EventRequest{Eventtype: api.EventTypeRestart, UUID: c.id}
+		}
+		if req == nil {
+			continue
+		}
+
+		msg, _ := codec.Marshal(req)
+		select {
+		case c.stream <- msg:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// move returns the turn for the frame, or nil if the snake goes straight or is dead.
+func (c *BotClient) move(resp *api.EventResponse) *api.EventRequest {
+	v := newBotView(resp, c.id, c.config.Topology == api.TopologyTorus)
+	if v == nil || v.me.Dead {
+		return nil
+	}
+	if c.rng.Float64() < c.difficulty.late {
+		return nil
+	}
+	v.cautious = c.difficulty.cautious
+	d := c.strategy.Next(v, c.rng)
+	if d == v.me.Direction {
+		return nil
+	}
+	return &api.EventRequest{Eventtype: api.EventTypeMove, Key: d, UUID: c.id}
+}
+
+// botView is a frame seen from a bot.
+type botView struct {
+	width  int
+	height int
+	torus  bool
+	board  []int
+	me     api.PlayerResponse
+	others []api.PlayerResponse
+	// cautious regards cells next to the heads of other snakes as blocked
+	cautious bool
+}
+
+// newBotView returns the view of the player id, or nil if the player is not in the frame.
+func newBotView(resp *api.EventResponse, id string, torus bool) *botView {
+	v := &botView{
+		width:  resp.Body.Width,
+		height: resp.Body.Height,
+		torus:  torus,
+		board:  resp.Body.Board,
+	}
+	found := false
+	for _, p := range resp.Body.Players {
+		if p.ID == id {
+			v.me = p
+			found = true
+		} else if !p.Dead {
+			v.others = append(v.others, p)
+		}
+	}
+	if !found || len(v.board) != v.width*v.height {
+		return nil
+	}
+	return v
+}
+
+var allDirections = []int{api.MoveLeft, api.MoveRight, api.MoveUp, api.MoveDown}
+
+// step returns the cell next to (x, y) in the direction, or false if it is out of the board.
+func (v *botView) step(x, y, d int) (int, int, bool) {
+	switch d {
+	case api.MoveLeft:
+		x--
+	case api.MoveRight:
+		x++
+	case api.MoveUp:
+		y--
+	case api.MoveDown:
+		y++
+	}
+	if v.torus {
+		return (x + v.width) % v.width, (y + v.height) % v.height, true
+	}
+	return x, y, x >= 0 && x < v.width && y >= 0 && y < v.height
+}
+
+// free reports whether a head can move to the cell in the next tick.
+// A tail which moves away in the tick is free.
+func (v *botView) free(x, y int) bool {
+	c := v.board[y*v.width+x]
+	return c != api.CellWall && c <= 1
+}
+
+// contested reports whether the head of another snake can reach the cell in the next tick.
+func (v *botView) contested(x, y int) bool {
+	for _, p := range v.others {
+		for _, d := range allDirections {
+			if nx, ny, ok := v.step(p.X, p.Y, d); ok && nx == x && ny == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// moves returns the directions which do not run into anything in the next tick.
+func (v *botView) moves() []int {
+	var safe, risky []int
+	for _, d := range allDirections {
+		if isReverse(v.me.Direction, d) {
+			continue
+		}
+		x, y, ok := v.step(v.me.X, v.me.Y, d)
+		if !ok || !v.free(x, y) {
+			continue
+		}
+		if v.cautious && v.contested(x, y) {
+			risky = append(risky, d)
+			continue
+		}
+		safe = append(safe, d)
+	}
+	if len(safe) == 0 {
+		return risky
+	}
+	return safe
+}
+
+// space returns the number of free cells reachable from the cell after moving in the direction, up to limit.
+func (v *botView) space(d, limit int) int {
+	x, y, _ := v.step(v.me.X, v.me.Y, d)
+	seen := make([]bool, len(v.board))
+	seen[y*v.width+x] = true
+	queue := [][2]int{{x, y}}
+	n := 0
+	for len(queue) > 0 && n < limit {
+		c := queue[0]
+		queue = queue[1:]
+		n++
+		for _, dd := range allDirections {
+			nx, ny, ok := v.step(c[0], c[1], dd)
+			if !ok || seen[ny*v.width+nx] || !v.free(nx, ny) {
+				continue
+			}
+			seen[ny*v.width+nx] = true
+			queue = append(queue, [2]int{nx, ny})
+		}
+	}
+	return n
+}
+
+// towardApple returns the first direction of the shortest path to the nearest apple among moves.
+func (v *botView) towardApple(moves []int) (int, bool) {
+	seen := make([]bool, len(v.board))
+	seen[v.me.Y*v.width+v.me.X] = true
+	type node struct{ x, y, first int }
+	var queue []node
+	for _, d := range moves {
+		x, y, _ := v.step(v.me.X, v.me.Y, d)
+		seen[y*v.width+x] = true
+		queue = append(queue, node{x, y, d})
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if v.board[n.y*v.width+n.x] == api.CellApple {
+			return n.first, true
+		}
+		for _, d := range allDirections {
+			x, y, ok := v.step(n.x, n.y, d)
+			if !ok || seen[y*v.width+x] || !v.free(x, y) {
+				continue
+			}
+			seen[y*v.width+x] = true
+			queue = append(queue, node{x, y, n.first})
+		}
+	}
+	return 0, false
+}
+
+// wander goes straight if possible, and turns now and then.
+func (v *botView) wander(moves []int, rng *rand.Rand) int {
+	if len(moves) == 0 {
+		return v.me.Direction
+	}
+	for _, d := range moves {
+		if d == v.me.Direction && rng.Intn(5) > 0 {
+			return d
+		}
+	}
+	return moves[rng.Intn(len(moves))]
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) Next(v *botView, rng *rand.Rand) int {
+	return v.wander(v.moves(), rng)
+}
+
+type greedyStrategy struct{}
+
+func (greedyStrategy) Next(v *botView, rng *rand.Rand) int {
+	moves := v.moves()
+	if d, ok := v.towardApple(moves); ok {
+		return d
+	}
+	return v.wander(moves, rng)
+}
+
+// survivalStrategy flood-fills the board from each move, and only takes moves with room for the whole snake.
+type survivalStrategy struct{}
+
+func (survivalStrategy) Next(v *botView, rng *rand.Rand) int {
+	moves := v.moves()
+	need := len(v.me.Body) + 1
+	var roomy []int
+	best, bestSpace := v.me.Direction, -1
+	for _, d := range moves {
+		s := v.space(d, need)
+		if s >= need {
+			roomy = append(roomy, d)
+		}
+		if s > bestSpace {
+			best, bestSpace = d, s
+		}
+	}
+	if len(roomy) == 0 {
+		return best
+	}
+	if d, ok := v.towardApple(roomy); ok {
+		return d
+	}
+	return v.wander(roomy, rng)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/myoan/snake/api"
+)
+
+// newTestView returns a 10x10 view whose snake heads to the direction at (x, y), with the body behind it.
+func newTestView(x, y, direction int, body []api.Point) *botView {
+	board := make([]int, 100)
+	for i, p := range body {
+		board[p.Y*10+p.X] = len(body) - i
+	}
+	return &botView{
+		width:  10,
+		height: 10,
+		board:  board,
+		me: api.PlayerResponse{
+			ID:        "bot",
+			X:         x,
+			Y:         y,
+			Direction: direction,
+			Body:      body,
+		},
+	}
+}
+
+func TestStrategy_Edge(t *testing.T) {
+	for _, name := range []string{BotRandom, BotGreedy, BotSurvival} {
+		s, _ := NewStrategy(name)
+		for i := 0; i < 20; i++ {
+			v := newTestView(9, 5, api.MoveRight, []api.Point{{X: 9, Y: 5}, {X: 8, Y: 5}, {X: 7, Y: 5}})
+			d := s.Next(v, rand.New(rand.NewSource(int64(i))))
+			if d != api.MoveUp && d != api.MoveDown {
+				t.Fatalf("%s: expected to turn at the edge, but got %d", name, d)
+			}
+		}
+	}
+}
+
+func TestStrategy_DeadEnd(t *testing.T) {
+	// an apple in a pocket on the left, and open space on the right
+	v := newTestView(5, 5, api.MoveUp, []api.Point{{X: 5, Y: 5}, {X: 5, Y: 6}, {X: 5, Y: 7}, {X: 5, Y: 8}, {X: 5, Y: 9}})
+	for _, w := range [][2]int{{5, 4}, {4, 4}, {3, 4}, {2, 5}, {3, 6}, {4, 6}} {
+		v.board[w[1]*10+w[0]] = api.CellWall
+	}
+	v.board[5*10+3] = api.CellApple
+	rng := rand.New(rand.NewSource(1))
+
+	if d := (greedyStrategy{}).Next(v, rng); d != api.MoveLeft {
+		t.Errorf("greedy: expected to go for the apple, but got %d", d)
+	}
+	if d := (survivalStrategy{}).Next(v, rng); d != api.MoveRight {
+		t.Errorf("survival: expected to avoid the dead end, but got %d", d)
+	}
+}
+
+func TestStrategy_Cautious(t *testing.T) {
+	// another head can reach the cell in front of the snake
+	v := newTestView(5, 5, api.MoveRight, []api.Point{{X: 5, Y: 5}, {X: 4, Y: 5}, {X: 3, Y: 5}})
+	v.others = []api.PlayerResponse{{ID: "other", X: 7, Y: 5, Direction: api.MoveLeft}}
+	v.cautious = true
+	for _, d := range v.moves() {
+		if d == api.MoveRight {
+			t.Errorf("cautious bot should not move to a contested cell")
+		}
+	}
+}
+
+func TestGameEngine_Bots(t *testing.T) {
+	cfg := DefaultGameConfig()
+	cfg.Width = 20
+	cfg.Height = 20
+	cfg.PlayerNum = 3
+	cfg.TickInterval = 10
+	cfg.WinCondition = api.WinTimeLimit
+	cfg.TimeLimit = 1
+	cfg.RematchTimeout = 0
+	cfg.ResumeGrace = 0
+	cfg.BotWait = 1
+	fw, _ := NewNopFrameWork()
+	ge := NewGameEngine(cfg, fw, 1, "")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ingameHandler(ge, w, r)
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	c := dialTestClient(t, url, api.Hello{})
+	c.play(rand.New(rand.NewSource(1)), 0)
+	if c.result == nil {
+		t.Fatalf("result not received")
+	}
+	bots := 0
+	for _, s := range c.result.Body.Standings {
+		if strings.HasPrefix(s.ID, "bot-") {
+			bots++
+		}
+	}
+	if bots != cfg.PlayerNum-1 {
+		t.Errorf("bots: expected %d, but got %d", cfg.PlayerNum-1, bots)
+	}
+
+	// bots leave with the player
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		ge.mu.Lock()
+		n := len(ge.Rooms)
+		ge.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rooms: expected 0, but got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,10 +1,36 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/myoan/snake/api"
+)
+
+const (
+	// sendQueueSize is the number of frames a client can fall behind before it is evicted.
+	sendQueueSize = 64
+	// writeWait is how long a write can block before the connection is regarded as broken.
+	writeWait = 2 * time.Second
+)
+
+// Keepalive of connections, which clients copy when they are created. They are variables to shorten in tests.
+var (
+	// pingInterval is how often the server pings the client
+	pingInterval = 5 * time.Second
+	// pongWait is how long the server waits for a pong, or any message, before the connection is regarded as dead
+	pongWait = 3 * pingInterval
+)
+
+var (
+	errClientClosed = errors.New("client is closed")
+	errSlowClient   = errors.New("client is too slow to receive frames")
 )
 
 type WebClient struct {
@@ -12,15 +38,58 @@ type WebClient struct {
 	stream    chan []byte
 	conn      *websocket.Conn
 	observers []Observer
-	mu        sync.Mutex
+	// token is presented by the client to resume the session after the connection dropped
+	token string
+	// grace is how long the client can take to resume. 0 disables resuming.
+	grace time.Duration
+	// resume receives the new connection while the client is disconnected
+	resume chan *websocket.Conn
+	// out is the queue of frames drained by the writer goroutine
+	out chan []byte
+	// evicted is true while the client fell behind and has not resumed yet
+	evicted bool
+	// done is closed by Close, which stops requests waiting for the room which no longer reads them
+	done chan struct{}
+	// rtt is the smoothed round-trip time measured by pings, 0 until the first pong
+	rtt          time.Duration
+	pingInterval time.Duration
+	pongWait     time.Duration
+	closed       bool
+	opts         ClientOptions
+	mu           sync.Mutex
+}
+
+func NewWebClient(id string, conn *websocket.Conn, token string, grace time.Duration, opts ClientOptions) *WebClient {
+	return &WebClient{
+		uuid:      id,
+		stream:    make(chan []byte),
+		conn:      conn,
+		observers: make([]Observer, 0),
+		token:     token,
+		grace:     grace,
+		resume:    make(chan *websocket.Conn, 1),
+		out:       make(chan []byte, sendQueueSize),
+		done:      make(chan struct{}),
+		opts:      opts,
+
+		pingInterval: pingInterval,
+		pongWait:     pongWait,
+	}
 }
 
 func (c *WebClient) AddObserver(o Observer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.observers = append(c.observers, o)
 }
 
+// Notify calls observers without the lock, because they may send to the client.
 func (c *WebClient) Notify(tp int) {
-	for _, o := range c.observers {
+	c.mu.Lock()
+	observers := append([]Observer{}, c.observers...)
+	c.mu.Unlock()
+
+	for _, o := range observers {
 		data := TriggerArgument{
 			EventType: tp,
 			Client:    c,
@@ -33,40 +102,236 @@ func (c *WebClient) ID() string {
 	return c.uuid
 }
 
+func (c *WebClient) Token() string {
+	return c.token
+}
+
+func (c *WebClient) Options() ClientOptions {
+	return c.opts
+}
+
+// Send queues the frame for the writer goroutine, so that a slow client never blocks the room.
+// A client whose queue is full is evicted: the connection is closed, and the client can resume.
 func (c *WebClient) Send(data []byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	log.Printf("Send to client %s: %s", c.ID(), data)
-	err := c.conn.WriteMessage(websocket.TextMessage, data)
-	if err != nil {
-		log.Printf("[Error] write(%s): %v", c.ID(), err)
-		return err
+	if c.closed {
+		return errClientClosed
+	}
+	if c.evicted {
+		return errSlowClient
+	}
+
+	select {
+	case c.out <- data:
+		metricSendQueued.Add(1)
+		if n := int64(len(c.out)); n > metricSendQueuePeak.Value() {
+			metricSendQueuePeak.Set(n)
+		}
+		return nil
+	default:
+	}
+
+	log.Printf("Client %s has %d frames in the queue, evict", c.ID(), len(c.out))
+	metricEvictions.Add(1)
+	c.evicted = true
+	// the reader finds the closed connection, and waits for the client to resume
+	c.conn.Close()
+	return errSlowClient
+}
+
+// Latency returns the smoothed round-trip time to the client.
+func (c *WebClient) Latency() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rtt
+}
+
+// writeLoop writes frames in the queue to the connection until the client is closed,
+// and pings the client every ping interval.
+// After a write fails, frames are dropped until the client resumes with a new connection.
+// The connection is closed after the rest of the queue is written.
+func (c *WebClient) writeLoop() {
+	mt := messageType(c.opts.Codec())
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+	// broken is the connection whose write failed
+	var broken *websocket.Conn
+	for {
+		var err error
+		conn := c.connection()
+		select {
+		case data, ok := <-c.out:
+			if !ok {
+				c.connection().Close()
+				return
+			}
+			metricSendQueued.Add(-1)
+			conn = c.connection()
+			if conn == broken {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err = conn.WriteMessage(mt, data)
+		case <-ticker.C:
+			if conn == broken {
+				continue
+			}
+			// the pong echoes the time, which tells the round-trip time
+			now := strconv.FormatInt(time.Now().UnixNano(), 10)
+			err = conn.WriteControl(websocket.PingMessage, []byte(now), time.Now().Add(writeWait))
+		}
+		if err != nil {
+			log.Printf("[Error] write(%s): %v", c.ID(), err)
+			metricWriteErrors.Add(1)
+			broken = conn
+			conn.Close()
+		}
 	}
-	return nil
+}
+
+// connection returns the current connection, which changes when the client resumes.
+func (c *WebClient) connection() *websocket.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// keepalive makes reads from conn fail if the client answers neither pings nor anything else within the pong wait.
+func (c *WebClient) keepalive(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(c.pongWait))
+	conn.SetPongHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(c.pongWait))
+		sent, err := strconv.ParseInt(data, 10, 64)
+		if err != nil {
+			// not an answer to our ping
+			return nil
+		}
+		sample := time.Since(time.Unix(0, sent))
+		c.mu.Lock()
+		if c.rtt == 0 {
+			c.rtt = sample
+		} else {
+			// smoothed like TCP, so that one late pong does not swing the latency
+			c.rtt += (sample - c.rtt) / 8
+		}
+		c.mu.Unlock()
+		return nil
+	})
+}
+
+// messageType returns the websocket message type which carries frames of the codec.
+func messageType(codec api.Codec) int {
+	if codec.Binary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
 }
 
 func (c *WebClient) Stream() chan []byte {
 	return c.stream
 }
 
+// Run reads requests from the connection into stream, and starts the writer goroutine.
+// When the connection drops, it waits for the client to resume within the grace,
+// and keeps reading from the new connection. Otherwise the stream is closed.
+// It also returns when the client is closed, so that a request nobody reads never blocks it.
 func (c *WebClient) Run(stream chan []byte) {
+	go c.writeLoop()
+
+	conn := c.connection()
+	c.keepalive(conn)
+
 	for {
-		mt, message, err := c.conn.ReadMessage()
+		mt, message, err := conn.ReadMessage()
 		if err != nil {
 			log.Println("[Error] read: ", err)
 			log.Printf("message type: %d", mt)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				log.Printf("Client %s did not answer pings for %v", c.ID(), c.pongWait)
+				metricPongTimeouts.Add(1)
+			}
+			conn = c.waitResume()
+			if conn != nil {
+				c.keepalive(conn)
+				continue
+			}
 			close(stream)
 			c.Close()
 			return
 		}
-		log.Printf("recv: %s", message)
+		conn.SetReadDeadline(time.Now().Add(c.pongWait))
+
+		select {
+		case stream <- message:
+		case <-c.done:
+			// the room stopped reading, or the client never joined one
+			close(stream)
+			return
+		}
+	}
+}
+
+// waitResume returns the new connection if the client resumes within the grace, or nil.
+func (c *WebClient) waitResume() *websocket.Conn {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed || c.grace == 0 {
+		return nil
+	}
+
+	log.Printf("Client %s disconnected, wait %v to resume", c.ID(), c.grace)
+	t := time.NewTimer(c.grace)
+	defer t.Stop()
+	select {
+	case conn := <-c.resume:
+		return conn
+	case <-t.C:
+		return nil
+	}
+}
+
+// Resume replaces the connection with a new one of the same client.
+// The old connection is closed if it is still open.
+func (c *WebClient) Resume(conn *websocket.Conn) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return fmt.Errorf("session %s is already closed", c.ID())
+	}
 
-		stream <- message
+	select {
+	case c.resume <- conn:
+	default:
+		return fmt.Errorf("session %s is already resuming", c.ID())
 	}
+	// frames for the old connection are useless, and the client receives a keyframe after resuming
+	for len(c.out) > 0 {
+		<-c.out
+		metricSendQueued.Add(-1)
+	}
+	c.evicted = false
+	old := c.conn
+	c.conn = conn
+	old.Close()
+	log.Printf("Client %s resumed", c.ID())
+	return nil
 }
 
+// Close disconnects the client after the frames in the queue are written.
+// It notifies EventClientFinish only once.
 func (c *WebClient) Close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.out)
+	close(c.done)
+	c.mu.Unlock()
+
 	log.Printf("Close client %s", c.ID())
 	c.Notify(EventClientFinish)
-	c.conn.Close()
 }
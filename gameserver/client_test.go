@@ -0,0 +1,240 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebClient_Resume(t *testing.T) {
+	conns := make(chan *websocket.Conn)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- c
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	dial := func() *websocket.Conn {
+		c, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	recv := func(client *WebClient) string {
+		select {
+		case msg, ok := <-client.Stream():
+			if !ok {
+				t.Fatalf("stream is closed")
+			}
+			return string(msg)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+		return ""
+	}
+
+	first := dial()
+	client := NewWebClient("a", <-conns, "token", time.Second, ClientOptions{})
+	go client.Run(client.Stream())
+	first.WriteMessage(websocket.TextMessage, []byte("before"))
+	if msg := recv(client); msg != "before" {
+		t.Errorf("message: expected 'before', but got '%s'", msg)
+	}
+
+	first.Close()
+	second := dial()
+	defer second.Close()
+	err := client.Resume(<-conns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.WriteMessage(websocket.TextMessage, []byte("after"))
+	if msg := recv(client); msg != "after" {
+		t.Errorf("message: expected 'after', but got '%s'", msg)
+	}
+
+	client.Close()
+	if err := client.Resume(nil); err == nil {
+		t.Errorf("closed client should not resume")
+	}
+}
+
+// newTestConns returns both ends of a websocket connection.
+func newTestConns(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	conns := make(chan *websocket.Conn)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- c
+	}))
+	t.Cleanup(srv.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	return <-conns, peer
+}
+
+func TestWebClient_Send_Evict(t *testing.T) {
+	conn, peer := newTestConns(t)
+	// the writer is not running, so that the queue never drains
+	client := NewWebClient("a", conn, "", 0, ClientOptions{})
+
+	evictions := metricEvictions.Value()
+	for i := 0; i < sendQueueSize; i++ {
+		err := client.Send([]byte("frame"))
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	if err := client.Send([]byte("frame")); err != errSlowClient {
+		t.Errorf("expected errSlowClient for a full queue, but got %v", err)
+	}
+	if n := metricEvictions.Value() - evictions; n != 1 {
+		t.Errorf("evictions: expected 1, but got %d", n)
+	}
+
+	// the connection is closed
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := peer.ReadMessage(); err == nil {
+		t.Errorf("evicted connection should be closed")
+	}
+}
+
+func TestWebClient_WriteError(t *testing.T) {
+	conn, _ := newTestConns(t)
+	client := NewWebClient("a", conn, "", 0, ClientOptions{})
+	// every write fails on the closed connection
+	conn.Close()
+
+	errors := metricWriteErrors.Value()
+	for i := 0; i < 3; i++ {
+		client.Send([]byte("frame"))
+	}
+	client.Close()
+	client.writeLoop()
+
+	if n := metricWriteErrors.Value() - errors; n != 1 {
+		t.Errorf("write errors: expected 1, but got %d", n)
+	}
+}
+
+func TestWebClient_Close_Flush(t *testing.T) {
+	conn, peer := newTestConns(t)
+	client := NewWebClient("a", conn, "", 0, ClientOptions{})
+	go client.Run(client.Stream())
+
+	frames := []string{"1", "2", "3"}
+	for _, f := range frames {
+		client.Send([]byte(f))
+	}
+	client.Close()
+	if err := client.Send([]byte("4")); err != errClientClosed {
+		t.Errorf("expected errClientClosed after close, but got %v", err)
+	}
+
+	// frames queued before close are written
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	for _, f := range frames {
+		_, msg, err := peer.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != f {
+			t.Errorf("expected '%s', but got '%s'", f, msg)
+		}
+	}
+	if _, _, err := peer.ReadMessage(); err == nil {
+		t.Errorf("connection should be closed after the queue")
+	}
+}
+
+func TestWebClient_Close_Reader(t *testing.T) {
+	conn, peer := newTestConns(t)
+	client := NewWebClient("a", conn, "", 0, ClientOptions{})
+	returned := make(chan struct{})
+	go func() {
+		client.Run(client.Stream())
+		close(returned)
+	}()
+
+	// nobody reads the request, like a client whose room is gone
+	peer.WriteMessage(websocket.TextMessage, []byte("late"))
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatalf("reader should return after close")
+	}
+}
+
+func TestWebClient_Keepalive(t *testing.T) {
+	interval, wait := pingInterval, pongWait
+	pingInterval, pongWait = 20*time.Millisecond, 100*time.Millisecond
+	conn, peer := newTestConns(t)
+	client := NewWebClient("a", conn, "", 0, ClientOptions{})
+	pingInterval, pongWait = interval, wait
+	go client.Run(client.Stream())
+
+	// the peer answers pings while it reads
+	answering := make(chan bool, 1)
+	answering <- true
+	peer.SetPingHandler(func(data string) error {
+		ok := <-answering
+		answering <- ok
+		if !ok {
+			return nil
+		}
+		return peer.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		for {
+			if _, _, err := peer.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for client.Latency() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("latency is not measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a peer which stops answering is dropped
+	timeouts := metricPongTimeouts.Value()
+	<-answering
+	answering <- false
+	select {
+	case _, ok := <-client.Stream():
+		if ok {
+			t.Fatalf("unexpected message")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("silent peer is not dropped")
+	}
+	if n := metricPongTimeouts.Value() - timeouts; n != 1 {
+		t.Errorf("pong timeouts: expected 1, but got %d", n)
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/myoan/snake/api"
+	"gopkg.in/yaml.v2"
+)
+
+// GameConfig is the set of rules of a match.
+type GameConfig struct {
+	Width  int `json:"width" yaml:"width"`
+	Height int `json:"height" yaml:"height"`
+	// PlayerNum is the maximum players of a match. The match starts at once when it is full.
+	PlayerNum int `json:"player_num" yaml:"player_num"`
+	// MinPlayers is the players needed to start the countdown. 0 means PlayerNum.
+	MinPlayers int `json:"min_players" yaml:"min_players"`
+	// Countdown is the seconds more players can join after MinPlayers have joined
+	Countdown      int    `json:"countdown" yaml:"countdown"`
+	InitSize       int    `json:"init_size" yaml:"init_size"`
+	TickInterval   int    `json:"tick_interval" yaml:"tick_interval"` // milliseconds
+	AppleNum       int    `json:"apple_num" yaml:"apple_num"`
+	GrowthPerApple int    `json:"growth_per_apple" yaml:"growth_per_apple"`
+	Topology       string `json:"topology" yaml:"topology"`
+	// WinCondition decides when the match finishes and how players are ranked
+	WinCondition string `json:"win_condition" yaml:"win_condition"`
+	// TargetLength is the length to win with WinLength. In a team match, it is the combined length of a team.
+	TargetLength int `json:"target_length" yaml:"target_length"`
+	// TimeLimit is the length of a match in seconds with WinTimeLimit
+	TimeLimit int `json:"time_limit" yaml:"time_limit"`
+	// Teams is the number of teams players are assigned to at the start of a match. 0 disables teams.
+	Teams int `json:"teams" yaml:"teams"`
+	// TeamBodies is whether the bodies of teammates are lethal or passable
+	TeamBodies string `json:"team_bodies" yaml:"team_bodies"`
+	// RematchTimeout is the seconds to wait for every player to ask for a rematch. 0 disables rematches.
+	RematchTimeout int `json:"rematch_timeout" yaml:"rematch_timeout"`
+	// ResumeGrace is the seconds to wait for a dropped client to resume the session. 0 disables resuming.
+	ResumeGrace int `json:"resume_grace" yaml:"resume_grace"`
+	// KeyframeInterval is the ticks between full frames for clients which receive delta frames
+	KeyframeInterval int `json:"keyframe_interval" yaml:"keyframe_interval"`
+	// BotWait is the seconds a player waits for others before bots fill the rest of the match. 0 disables bots.
+	BotWait int `json:"bot_wait" yaml:"bot_wait"`
+	// BotStrategy is how bots play (random, greedy, survival)
+	BotStrategy string `json:"bot_strategy" yaml:"bot_strategy"`
+	// BotDifficulty is how often bots react late (easy, normal, hard)
+	BotDifficulty string `json:"bot_difficulty" yaml:"bot_difficulty"`
+	// Items are the kinds of items spawned besides apples
+	Items []ItemConfig `json:"items" yaml:"items"`
+	// Map is the path of the map file. Its size overrides Width and Height.
+	Map string `json:"map" yaml:"map"`
+	// Seed is the seed of every match. 0 means a new seed is picked for each match.
+	Seed int64 `json:"seed" yaml:"seed"`
+
+	gameMap *GameMap
+}
+
+func DefaultGameConfig() *GameConfig {
+	return &GameConfig{
+		Width:            40,
+		Height:           40,
+		PlayerNum:        2,
+		Countdown:        10,
+		InitSize:         3,
+		TickInterval:     100,
+		AppleNum:         1,
+		GrowthPerApple:   1,
+		Topology:         api.TopologyWall,
+		WinCondition:     api.WinLastAlive,
+		TeamBodies:       api.TeamBodyLethal,
+		KeyframeInterval: 50,
+		BotStrategy:      BotSurvival,
+		BotDifficulty:    BotNormal,
+	}
+}
+
+// LoadGameConfig builds the config in order of precedence: flags, environment variables, config file and defaults.
+// Flags must be registered by RegisterFlags and parsed before calling this.
+func LoadGameConfig(path string, fs *flag.FlagSet, flagCfg *GameConfig) (*GameConfig, error) {
+	cfg := DefaultGameConfig()
+
+	if path != "" {
+		err := cfg.loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := cfg.loadEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "width":
+			cfg.Width = flagCfg.Width
+		case "height":
+			cfg.Height = flagCfg.Height
+		case "players":
+			cfg.PlayerNum = flagCfg.PlayerNum
+		case "min-players":
+			cfg.MinPlayers = flagCfg.MinPlayers
+		case "countdown":
+			cfg.Countdown = flagCfg.Countdown
+		case "init-size":
+			cfg.InitSize = flagCfg.InitSize
+		case "tick":
+			cfg.TickInterval = flagCfg.TickInterval
+		case "apples":
+			cfg.AppleNum = flagCfg.AppleNum
+		case "growth":
+			cfg.GrowthPerApple = flagCfg.GrowthPerApple
+		case "topology":
+			cfg.Topology = flagCfg.Topology
+		case "win":
+			cfg.WinCondition = flagCfg.WinCondition
+		case "target-length":
+			cfg.TargetLength = flagCfg.TargetLength
+		case "time-limit":
+			cfg.TimeLimit = flagCfg.TimeLimit
+		case "teams":
+			cfg.Teams = flagCfg.Teams
+		case "team-bodies":
+			cfg.TeamBodies = flagCfg.TeamBodies
+		case "rematch-timeout":
+			cfg.RematchTimeout = flagCfg.RematchTimeout
+		case "resume-grace":
+			cfg.ResumeGrace = flagCfg.ResumeGrace
+		case "keyframe":
+			cfg.KeyframeInterval = flagCfg.KeyframeInterval
+		case "bot-wait":
+			cfg.BotWait = flagCfg.BotWait
+		case "bot-strategy":
+			cfg.BotStrategy = flagCfg.BotStrategy
+		case "bot-difficulty":
+			cfg.BotDifficulty = flagCfg.BotDifficulty
+		case "map":
+			cfg.Map = flagCfg.Map
+		case "seed":
+			cfg.Seed = flagCfg.Seed
+		}
+	})
+
+	if cfg.Map != "" {
+		m, err := LoadGameMap(cfg.Map)
+		if err != nil {
+			return nil, err
+		}
+		cfg.gameMap = m
+		cfg.Width = m.Width
+		cfg.Height = m.Height
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// RegisterFlags registers the config flags to fs.
+// Only flags which are set explicitly override the other sources.
+func (cfg *GameConfig) RegisterFlags(fs *flag.FlagSet) {
+	def := DefaultGameConfig()
+	fs.IntVar(&cfg.Width, "width", def.Width, "board width")
+	fs.IntVar(&cfg.Height, "height", def.Height, "board height")
+	fs.IntVar(&cfg.PlayerNum, "players", def.PlayerNum, "maximum players per match")
+	fs.IntVar(&cfg.MinPlayers, "min-players", def.MinPlayers, "players to start the countdown (0: same as -players)")
+	fs.IntVar(&cfg.Countdown, "countdown", def.Countdown, "seconds more players can join after the minimum has joined")
+	fs.IntVar(&cfg.InitSize, "init-size", def.InitSize, "starting length of snakes")
+	fs.IntVar(&cfg.TickInterval, "tick", def.TickInterval, "tick interval in milliseconds")
+	fs.IntVar(&cfg.AppleNum, "apples", def.AppleNum, "apples on the board")
+	fs.IntVar(&cfg.GrowthPerApple, "growth", def.GrowthPerApple, "growth per apple")
+	fs.StringVar(&cfg.Topology, "topology", def.Topology, "board topology (wall, torus)")
+	fs.StringVar(&cfg.WinCondition, "win", def.WinCondition, "win condition (last_alive, length, time_limit)")
+	fs.IntVar(&cfg.TargetLength, "target-length", def.TargetLength, "length to win with the length condition")
+	fs.IntVar(&cfg.TimeLimit, "time-limit", def.TimeLimit, "match length in seconds with the time_limit condition")
+	fs.IntVar(&cfg.Teams, "teams", def.Teams, "teams players are assigned to (0: no teams)")
+	fs.StringVar(&cfg.TeamBodies, "team-bodies", def.TeamBodies, "bodies of teammates (lethal, passable)")
+	fs.IntVar(&cfg.RematchTimeout, "rematch-timeout", def.RematchTimeout, "seconds to wait for a rematch (0: disabled)")
+	fs.IntVar(&cfg.ResumeGrace, "resume-grace", def.ResumeGrace, "seconds to wait for a dropped client to resume (0: disabled)")
+	fs.IntVar(&cfg.KeyframeInterval, "keyframe", def.KeyframeInterval, "ticks between full frames for delta clients")
+	fs.IntVar(&cfg.BotWait, "bot-wait", def.BotWait, "seconds to wait for players before bots fill the match (0: no bots)")
+	fs.StringVar(&cfg.BotStrategy, "bot-strategy", def.BotStrategy, "bot strategy (random, greedy, survival)")
+	fs.StringVar(&cfg.BotDifficulty, "bot-difficulty", def.BotDifficulty, "bot difficulty (easy, normal, hard)")
+	fs.StringVar(&cfg.Map, "map", def.Map, "map file (.json or text)")
+	fs.Int64Var(&cfg.Seed, "seed", def.Seed, "seed of every match (0: random per match)")
+}
+
+func (cfg *GameConfig) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch filepath.Ext(path) {
+	case ".json":
+		err = json.Unmarshal(data, cfg)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("unknown config format: %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("parse %s: %v", path, err)
+	}
+	return nil
+}
+
+func (cfg *GameConfig) loadEnv() error {
+	envs := []struct {
+		name  string
+		value *int
+	}{
+		{"SNAKE_WIDTH", &cfg.Width},
+		{"SNAKE_HEIGHT", &cfg.Height},
+		{"SNAKE_PLAYER_NUM", &cfg.PlayerNum},
+		{"SNAKE_MIN_PLAYERS", &cfg.MinPlayers},
+		{"SNAKE_COUNTDOWN", &cfg.Countdown},
+		{"SNAKE_INIT_SIZE", &cfg.InitSize},
+		{"SNAKE_TICK_INTERVAL", &cfg.TickInterval},
+		{"SNAKE_APPLE_NUM", &cfg.AppleNum},
+		{"SNAKE_GROWTH_PER_APPLE", &cfg.GrowthPerApple},
+		{"SNAKE_TARGET_LENGTH", &cfg.TargetLength},
+		{"SNAKE_TIME_LIMIT", &cfg.TimeLimit},
+		{"SNAKE_TEAMS", &cfg.Teams},
+		{"SNAKE_REMATCH_TIMEOUT", &cfg.RematchTimeout},
+		{"SNAKE_RESUME_GRACE", &cfg.ResumeGrace},
+		{"SNAKE_KEYFRAME_INTERVAL", &cfg.KeyframeInterval},
+		{"SNAKE_BOT_WAIT", &cfg.BotWait},
+	}
+
+	for _, env := range envs {
+		s, ok := os.LookupEnv(env.name)
+		if !ok {
+			continue
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", env.name, err)
+		}
+		*env.value = v
+	}
+
+	if s, ok := os.LookupEnv("SNAKE_TOPOLOGY"); ok {
+		cfg.Topology = s
+	}
+
+	if s, ok := os.LookupEnv("SNAKE_WIN_CONDITION"); ok {
+		cfg.WinCondition = s
+	}
+
+	if s, ok := os.LookupEnv("SNAKE_TEAM_BODIES"); ok {
+		cfg.TeamBodies = s
+	}
+
+	if s, ok := os.LookupEnv("SNAKE_BOT_STRATEGY"); ok {
+		cfg.BotStrategy = s
+	}
+
+	if s, ok := os.LookupEnv("SNAKE_BOT_DIFFICULTY"); ok {
+		cfg.BotDifficulty = s
+	}
+
+	if s, ok := os.LookupEnv("SNAKE_MAP"); ok {
+		cfg.Map = s
+	}
+
+	if s, ok := os.LookupEnv("SNAKE_SEED"); ok {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("SNAKE_SEED: %v", err)
+		}
+		cfg.Seed = v
+	}
+	return nil
+}
+
+// Validate returns error if the config can not make a playable match.
+func (cfg *GameConfig) Validate() error {
+	if cfg.Width < 5 || cfg.Height < 5 {
+		return fmt.Errorf("board must be at least 5x5 (%dx%d)", cfg.Width, cfg.Height)
+	}
+	if cfg.PlayerNum < 1 {
+		return fmt.Errorf("players per match must be positive (%d)", cfg.PlayerNum)
+	}
+	if cfg.MinPlayers < 0 || cfg.MinPlayers > cfg.PlayerNum {
+		return fmt.Errorf("minimum players must be between 0 and %d (%d)", cfg.PlayerNum, cfg.MinPlayers)
+	}
+	if cfg.Countdown < 0 {
+		return fmt.Errorf("countdown must not be negative (%d)", cfg.Countdown)
+	}
+	if cfg.InitSize < 1 {
+		return fmt.Errorf("starting length must be positive (%d)", cfg.InitSize)
+	}
+	if cfg.TickInterval < 10 {
+		return fmt.Errorf("tick interval must be at least 10ms (%d)", cfg.TickInterval)
+	}
+	if cfg.AppleNum < 1 {
+		return fmt.Errorf("apples on the board must be positive (%d)", cfg.AppleNum)
+	}
+	if cfg.GrowthPerApple < 1 {
+		return fmt.Errorf("growth per apple must be positive (%d)", cfg.GrowthPerApple)
+	}
+	if cfg.Topology != api.TopologyWall && cfg.Topology != api.TopologyTorus {
+		return fmt.Errorf("unknown topology '%s'", cfg.Topology)
+	}
+	switch cfg.WinCondition {
+	case api.WinLastAlive:
+	case api.WinLength:
+		if cfg.TargetLength <= cfg.InitSize {
+			return fmt.Errorf("target length must be longer than the starting length (%d)", cfg.TargetLength)
+		}
+	case api.WinTimeLimit:
+		if cfg.TimeLimit < 1 {
+			return fmt.Errorf("time limit must be positive (%d)", cfg.TimeLimit)
+		}
+	default:
+		return fmt.Errorf("unknown win condition '%s'", cfg.WinCondition)
+	}
+	if cfg.Teams < 0 || cfg.Teams == 1 || cfg.Teams > len(teamColors) {
+		return fmt.Errorf("teams must be 0 or between 2 and %d (%d)", len(teamColors), cfg.Teams)
+	}
+	if cfg.Teams > cfg.PlayerNum {
+		return fmt.Errorf("teams must not be more than players per match (%d > %d)", cfg.Teams, cfg.PlayerNum)
+	}
+	if cfg.Teams > 0 && cfg.WinCondition == api.WinLength {
+		// the largest team starts with the combined length of its snakes
+		start := cfg.InitSize * ((cfg.PlayerNum + cfg.Teams - 1) / cfg.Teams)
+		if cfg.TargetLength <= start {
+			return fmt.Errorf("target length must be longer than the starting length of a team (%d <= %d)", cfg.TargetLength, start)
+		}
+	}
+	if cfg.TeamBodies != api.TeamBodyLethal && cfg.TeamBodies != api.TeamBodyPassable {
+		return fmt.Errorf("unknown team bodies '%s'", cfg.TeamBodies)
+	}
+	if cfg.RematchTimeout < 0 {
+		return fmt.Errorf("rematch timeout must not be negative (%d)", cfg.RematchTimeout)
+	}
+	if cfg.ResumeGrace < 0 {
+		return fmt.Errorf("resume grace must not be negative (%d)", cfg.ResumeGrace)
+	}
+	if cfg.KeyframeInterval < 1 {
+		return fmt.Errorf("keyframe interval must be positive (%d)", cfg.KeyframeInterval)
+	}
+	if cfg.BotWait < 0 {
+		return fmt.Errorf("bot wait must not be negative (%d)", cfg.BotWait)
+	}
+	if _, err := NewStrategy(cfg.BotStrategy); err != nil {
+		return err
+	}
+	if _, ok := difficulties[cfg.BotDifficulty]; !ok {
+		return fmt.Errorf("unknown bot difficulty '%s'", cfg.BotDifficulty)
+	}
+	for i := range cfg.Items {
+		err := cfg.Items[i].Validate()
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.gameMap != nil && len(cfg.gameMap.Spawns) > 0 && len(cfg.gameMap.Spawns) < cfg.PlayerNum {
+		return fmt.Errorf("map has %d spawn points for %d players", len(cfg.gameMap.Spawns), cfg.PlayerNum)
+	}
+	free := cfg.Width * cfg.Height
+	if cfg.gameMap != nil {
+		free -= cfg.gameMap.WallCells()
+	}
+	if cfg.AppleNum+cfg.PlayerNum*(cfg.InitSize+1) > free/2 {
+		return fmt.Errorf("board %dx%d with %d free cells is too small for %d players and %d apples", cfg.Width, cfg.Height, free, cfg.PlayerNum, cfg.AppleNum)
+	}
+	return nil
+}
+
+func (cfg *GameConfig) Tick() time.Duration {
+	return time.Millisecond * time.Duration(cfg.TickInterval)
+}
+
+func (cfg *GameConfig) RematchWait() time.Duration {
+	return time.Second * time.Duration(cfg.RematchTimeout)
+}
+
+func (cfg *GameConfig) ResumeWait() time.Duration {
+	return time.Second * time.Duration(cfg.ResumeGrace)
+}
+
+// MinPlayerNum returns the players needed to start the countdown.
+func (cfg *GameConfig) MinPlayerNum() int {
+	if cfg.MinPlayers == 0 {
+		return cfg.PlayerNum
+	}
+	return cfg.MinPlayers
+}
+
+func (cfg *GameConfig) BotFillWait() time.Duration {
+	return time.Second * time.Duration(cfg.BotWait)
+}
+
+// TimeLimitTicks returns the last tick of a match with WinTimeLimit.
+func (cfg *GameConfig) TimeLimitTicks() int {
+	return cfg.TimeLimit * 1000 / cfg.TickInterval
+}
+
+// Protocol returns the config sent to clients.
+func (cfg *GameConfig) Protocol() api.GameConfig {
+	items := make([]api.ItemConfig, len(cfg.Items))
+	for i := range cfg.Items {
+		items[i] = cfg.Items[i].Protocol()
+	}
+	var teams []api.TeamConfig
+	teamBodies := ""
+	if cfg.Teams > 0 {
+		teams = make([]api.TeamConfig, cfg.Teams)
+		for i := range teams {
+			teams[i] = api.TeamConfig{ID: i + 1, Color: teamColors[i]}
+		}
+		teamBodies = cfg.TeamBodies
+	}
+	return api.GameConfig{
+		Width:            cfg.Width,
+		Height:           cfg.Height,
+		PlayerNum:        cfg.PlayerNum,
+		MinPlayers:       cfg.MinPlayerNum(),
+		Countdown:        cfg.Countdown,
+		InitSize:         cfg.InitSize,
+		TickInterval:     cfg.TickInterval,
+		AppleNum:         cfg.AppleNum,
+		GrowthPerApple:   cfg.GrowthPerApple,
+		Topology:         cfg.Topology,
+		Items:            items,
+		WinCondition:     cfg.WinCondition,
+		TargetLength:     cfg.TargetLength,
+		TimeLimit:        cfg.TimeLimit,
+		RematchTimeout:   cfg.RematchTimeout,
+		ResumeGrace:      cfg.ResumeGrace,
+		KeyframeInterval: cfg.KeyframeInterval,
+		Teams:            teams,
+		TeamBodies:       teamBodies,
+	}
+}
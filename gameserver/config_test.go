@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/myoan/snake/api"
+)
+
+func TestLoadGameConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		data  string
+		env   map[string]string
+		args  []string
+		check func(cfg *GameConfig) bool
+		err   string
+	}{
+		{
+			name:  "defaults",
+			check: func(cfg *GameConfig) bool { return cfg.Width == 40 && cfg.PlayerNum == 2 },
+		},
+		{
+			// rematches, resuming and bots are enabled by the deployment
+			name: "timers off by default",
+			check: func(cfg *GameConfig) bool {
+				return cfg.RematchTimeout == 0 && cfg.ResumeGrace == 0 && cfg.BotWait == 0
+			},
+		},
+		{
+			name: "timers from env",
+			env:  map[string]string{"SNAKE_REMATCH_TIMEOUT": "15", "SNAKE_RESUME_GRACE": "10", "SNAKE_BOT_WAIT": "30"},
+			check: func(cfg *GameConfig) bool {
+				return cfg.RematchTimeout == 15 && cfg.ResumeGrace == 10 && cfg.BotWait == 30
+			},
+		},
+		{
+			name:  "yaml",
+			file:  "config.yaml",
+			data:  "width: 30\nheight: 20\nwin_condition: time_limit\ntime_limit: 60\n",
+			check: func(cfg *GameConfig) bool { return cfg.Width == 30 && cfg.Height == 20 && cfg.TimeLimit == 60 },
+		},
+		{
+			name:  "json",
+			file:  "config.json",
+			data:  `{"player_num": 4, "topology": "torus"}`,
+			check: func(cfg *GameConfig) bool { return cfg.PlayerNum == 4 && cfg.Topology == api.TopologyTorus },
+		},
+		{
+			name: "env over file",
+			file: "config.yaml",
+			data: "width: 30\nheight: 30\n",
+			env:  map[string]string{"SNAKE_WIDTH": "25", "SNAKE_TOPOLOGY": "torus"},
+			check: func(cfg *GameConfig) bool {
+				return cfg.Width == 25 && cfg.Height == 30 && cfg.Topology == api.TopologyTorus
+			},
+		},
+		{
+			name:  "flags over env",
+			env:   map[string]string{"SNAKE_WIDTH": "25", "SNAKE_HEIGHT": "25"},
+			args:  []string{"-width", "20"},
+			check: func(cfg *GameConfig) bool { return cfg.Width == 20 && cfg.Height == 25 },
+		},
+		{
+			name:  "unset flags keep env",
+			env:   map[string]string{"SNAKE_PLAYER_NUM": "3"},
+			args:  []string{"-tick", "50"},
+			check: func(cfg *GameConfig) bool { return cfg.PlayerNum == 3 && cfg.TickInterval == 50 },
+		},
+		{
+			name: "unknown format",
+			file: "config.toml",
+			data: "width = 30",
+			err:  "unknown config format",
+		},
+		{
+			name: "broken yaml",
+			file: "config.yaml",
+			data: "width: [",
+			err:  "parse",
+		},
+		{
+			name: "broken env",
+			env:  map[string]string{"SNAKE_WIDTH": "wide"},
+			err:  "SNAKE_WIDTH",
+		},
+		{
+			name: "small board",
+			args: []string{"-width", "4"},
+			err:  "at least 5x5",
+		},
+		{
+			name: "unknown win condition",
+			env:  map[string]string{"SNAKE_WIN_CONDITION": "draw"},
+			err:  "unknown win condition",
+		},
+		{
+			name: "short target length",
+			args: []string{"-win", api.WinLength, "-target-length", "3"},
+			err:  "target length",
+		},
+		{
+			name: "short team target length",
+			args: []string{"-win", api.WinLength, "-target-length", "5", "-players", "4", "-teams", "2"},
+			err:  "starting length of a team",
+		},
+		{
+			name: "too many players",
+			args: []string{"-width", "5", "-height", "5", "-players", "4"},
+			err:  "too small",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.file != "" {
+				path = filepath.Join(t.TempDir(), tt.file)
+				err := ioutil.WriteFile(path, []byte(tt.data), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			flagCfg := &GameConfig{}
+			flagCfg.RegisterFlags(fs)
+			err := fs.Parse(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadGameConfig(path, fs, flagCfg)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error with '%s', but got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("unexpected config: %+v", cfg)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"reflect"
+
+	"github.com/myoan/snake/api"
+)
+
+// NewDeltaResponse returns the changes from the frame prev to the frame next.
+// Players who did not change are omitted.
+func NewDeltaResponse(prev, next *api.EventResponse) *api.DeltaResponse {
+	cells := make([]api.CellChange, 0)
+	w := next.Body.Width
+	for i, v := range next.Body.Board {
+		if prev.Body.Board[i] != v {
+			cells = append(cells, api.CellChange{X: i % w, Y: i / w, Value: v})
+		}
+	}
+
+	last := make(map[string]api.PlayerResponse, len(prev.Body.Players))
+	for _, p := range prev.Body.Players {
+		last[p.ID] = p
+	}
+	players := make([]api.PlayerResponse, 0)
+	for _, p := range next.Body.Players {
+		if lp, ok := last[p.ID]; ok && reflect.DeepEqual(lp, p) {
+			continue
+		}
+		players = append(players, p)
+	}
+
+	return &api.DeltaResponse{
+		Status: api.GameStatusDelta,
+		Body: api.DeltaBody{
+			Tick:    next.Body.Tick,
+			Cells:   cells,
+			Players: players,
+		},
+	}
+}
+
+// Resync makes the client receive a keyframe in the next tick,
+// which is needed when the client may have lost frames.
+func (game *Game) Resync(cid string) {
+	delete(game.synced, cid)
+}
+
+// broadcast sends the snapshot of the tick to every player and spectator.
+// Clients which accept delta frames receive only changes from the last tick between keyframes.
+// The snapshot is built once, and encoded once for each encoding. Every recipient receives
+// the same bytes in the envelope with its ID.
+func (game *Game) broadcast() {
+	resp := game.Response(api.GameStatusOK)
+	var delta *api.DeltaResponse
+	if game.last != nil && (game.tick-1)%game.config.KeyframeInterval != 0 {
+		delta = NewDeltaResponse(game.last, resp)
+	}
+	game.last = resp
+
+	keyframes := make(map[string][]byte)
+	deltas := make(map[string][]byte)
+	encode := func(cache map[string][]byte, opts ClientOptions, v interface{}) ([]byte, error) {
+		if data, ok := cache[opts.Encoding]; ok {
+			return data, nil
+		}
+		data, err := opts.Codec().Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		cache[opts.Encoding] = data
+		return data, nil
+	}
+
+	send := func(c Client, you string) error {
+		opts := c.Options()
+		var data []byte
+		var err error
+		if delta != nil && opts.Delta && game.synced[c.ID()] {
+			data, err = encode(deltas, opts, delta)
+		} else {
+			data, err = encode(keyframes, opts, resp)
+		}
+		if err == nil {
+			err = c.Send(opts.Codec().Envelope(data, you))
+		}
+		if err != nil {
+			// the client may apply the next delta to a wrong frame
+			game.Resync(c.ID())
+			return err
+		}
+		game.synced[c.ID()] = true
+		return nil
+	}
+
+	for _, p := range game.players {
+		err := send(p.Client, p.ID())
+		if err != nil {
+			// player sends close event if player lost
+			// So we ignore this error
+			log.Printf("Send error(%v) to client: %s", err, p.ID())
+		}
+	}
+	for _, s := range game.spectators {
+		err := send(s.Client, "")
+		if err != nil {
+			log.Printf("Send error(%v) to spectator: %s", err, s.ID())
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/myoan/snake/api"
+)
+
+// deltaClient applies frames as a client which accepts delta frames.
+type deltaClient struct {
+	DummyClient
+	statuses []int
+	frame    api.ResponseBody
+}
+
+func (c *deltaClient) Options() ClientOptions { return ClientOptions{Delta: true} }
+
+func (c *deltaClient) Send(data []byte) error {
+	var status api.EventResponse
+	json.Unmarshal(data, &status)
+	c.statuses = append(c.statuses, status.Status)
+
+	switch status.Status {
+	case api.GameStatusOK:
+		c.frame = status.Body
+	case api.GameStatusDelta:
+		var resp api.DeltaResponse
+		json.Unmarshal(data, &resp)
+		c.frame.ApplyDelta(resp.Body)
+	}
+	return nil
+}
+
+func TestGame_Broadcast_Delta(t *testing.T) {
+	cfg := DefaultGameConfig()
+	cfg.Topology = api.TopologyTorus
+	cfg.KeyframeInterval = 5
+	dc := &deltaClient{DummyClient: *NewDummyClient("a")}
+	players := []*Player{NewPlayer(dc, cfg), NewPlayer(NewDummyClient("b"), cfg)}
+	game := NewGame(cfg, 1, make(chan Event), players)
+
+	for i := 0; i < 12; i++ {
+		if i == 8 {
+			game.Resync("a")
+		}
+		game.step()
+		want := game.Response(api.GameStatusOK)
+		if !reflect.DeepEqual(dc.frame.Board, want.Body.Board) {
+			t.Fatalf("tick %d: board is different from the full frame", game.tick)
+		}
+		if !reflect.DeepEqual(dc.frame.Players, want.Body.Players) {
+			t.Fatalf("tick %d: players are different from the full frame", game.tick)
+		}
+	}
+
+	want := []int{
+		api.GameStatusOK, api.GameStatusDelta, api.GameStatusDelta, api.GameStatusDelta, api.GameStatusDelta,
+		api.GameStatusOK, api.GameStatusDelta, api.GameStatusDelta,
+		api.GameStatusOK, api.GameStatusDelta,
+		api.GameStatusOK, api.GameStatusDelta,
+	}
+	if !reflect.DeepEqual(dc.statuses, want) {
+		t.Errorf("statuses = %v, want %v", dc.statuses, want)
+	}
+}
+
+// frameClient keeps the last frame in the encoding.
+type frameClient struct {
+	DummyClient
+	encoding string
+	last     []byte
+}
+
+func (c *frameClient) Options() ClientOptions { return ClientOptions{Encoding: c.encoding} }
+func (c *frameClient) Send(data []byte) error { c.last = data; return nil }
+
+func TestGame_Broadcast_Envelope(t *testing.T) {
+	cfg := DefaultGameConfig()
+	clients := []*frameClient{
+		{DummyClient: *NewDummyClient("a"), encoding: api.EncodingJSON},
+		{DummyClient: *NewDummyClient("b"), encoding: api.EncodingBinary},
+		{DummyClient: *NewDummyClient("c"), encoding: api.EncodingBinary},
+	}
+	players := make([]*Player, len(clients))
+	for i, c := range clients {
+		players[i] = NewPlayer(c, cfg)
+	}
+	game := NewGame(cfg, 1, make(chan Event), players)
+	spectator := &frameClient{DummyClient: *NewDummyClient("s"), encoding: api.EncodingBinary}
+	game.AddSpectator(NewSpectator(spectator))
+	game.step()
+
+	want := game.Response(api.GameStatusOK)
+	for _, c := range append(clients, spectator) {
+		var resp api.EventResponse
+		err := c.Options().Codec().Unmarshal(c.last, &resp)
+		if err != nil {
+			t.Fatalf("%s: %v", c.id, err)
+		}
+		you := c.id
+		if c == spectator {
+			you = ""
+		}
+		if resp.You != you {
+			t.Errorf("%s: expected you '%s', but got '%s'", c.id, you, resp.You)
+		}
+		if !reflect.DeepEqual(resp.Body.Board, want.Body.Board) || len(resp.Body.Players) != len(want.Body.Players) {
+			t.Errorf("%s: frame is different from the snapshot", c.id)
+		}
+	}
+}
@@ -12,6 +12,8 @@ type IGameServerFrameWork interface {
 	Ready() error
 	Allocate() error
 	Shutdown() error
+	// SetAnnotation publishes the value on the game server, which the backend can read
+	SetAnnotation(key, value string) error
 }
 
 type AgonessFrameWork struct {
@@ -43,6 +45,10 @@ func (fw *AgonessFrameWork) Shutdown() error {
 	return fw.sdk.Shutdown()
 }
 
+func (fw *AgonessFrameWork) SetAnnotation(key, value string) error {
+	return fw.sdk.SetAnnotation(key, value)
+}
+
 // doHealth sends the regular Health Pings
 func (fw *AgonessFrameWork) doHealth(ctx context.Context, interval int) {
 	log.Print("Starting Health Ping")
@@ -76,3 +82,6 @@ func (fw *NopFrameWork) Allocate() error {
 func (fw *NopFrameWork) Shutdown() error {
 	return nil
 }
+func (fw *NopFrameWork) SetAnnotation(key, value string) error {
+	return nil
+}
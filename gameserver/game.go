@@ -1,68 +1,367 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"log"
 	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/myoan/snake/api"
 )
 
+// GameEngine is a registry of rooms hosted by this gameserver process.
+// New connections are routed to an open room, or to a freshly created one.
 type GameEngine struct {
-	Clients  []Client
-	SceneMng *SceneManager
-	Ingame   *Game
+	Rooms     []*Room
+	config    *GameConfig
+	fw        IGameServerFrameWork
+	maxRooms  int
+	replayDir string
+	allocated bool
+	// sessions are the clients which can resume by their token
+	sessions map[string]*session
+	mu       sync.Mutex
+	// annotateMu keeps annotations of the rooms in order without holding mu during the SDK call
+	annotateMu sync.Mutex
 }
 
-func NewGameEngine() *GameEngine {
-	rand.Seed(time.Now().Unix())
-	clients := make([]Client, 0)
-	mng := NewSceneManager()
+// NewGameEngine creates the room registry.
+// If replayDir is not empty, every match is recorded to a replay file in the directory.
+func NewGameEngine(cfg *GameConfig, fw IGameServerFrameWork, maxRooms int, replayDir string) *GameEngine {
+	rooms := make([]*Room, 0)
 	return &GameEngine{
-		Clients:  clients,
-		SceneMng: mng,
+		Rooms:     rooms,
+		config:    cfg,
+		fw:        fw,
+		maxRooms:  maxRooms,
+		replayDir: replayDir,
+		sessions:  make(map[string]*session),
 	}
 }
 
-func (ge *GameEngine) AddClient(c Client) {
-	ge.Clients = append(ge.Clients, c)
+// session is a client which joined a room, and can resume after its connection dropped.
+type session struct {
+	client   *WebClient
+	room     *Room
+	spectate bool
 }
 
-func (ge *GameEngine) DeleteClient(cid string) {
-	for i, c := range ge.Clients {
-		if c.ID() == cid {
-			ge.Clients = append(ge.Clients[:i], ge.Clients[i+1:]...)
-			return
+// RoomRequest is the room which the client asked for by the query parameters.
+type RoomRequest struct {
+	// Name is the room to join, which is created if it does not exist. Empty means any public room.
+	Name string
+	// Code is the join code of the room. A room created with a code is private.
+	Code string
+}
+
+// Join routes the client to an open room and notifies the room of the connection.
+// A spectator is routed to a running match if any, otherwise it waits in an open room.
+// A client which asked for a named room is routed only to the room.
+// If every room is busy and no more rooms can be created, the client is rejected.
+func (ge *GameEngine) Join(c *WebClient, spectate bool, rr RoomRequest) error {
+	room, err := ge.route(spectate, rr)
+	if err != nil {
+		return err
+	}
+
+	c.AddObserver(room)
+	if c.Token() != "" {
+		ge.mu.Lock()
+		ge.sessions[c.Token()] = &session{client: c, room: room, spectate: spectate}
+		ge.mu.Unlock()
+		c.AddObserver(ge)
+	}
+	if spectate {
+		c.Notify(EventClientSpectate)
+	} else {
+		c.Notify(EventClientConnect)
+	}
+	return nil
+}
+
+// route picks the room for a new client, and reserves it until the client arrives.
+func (ge *GameEngine) route(spectate bool, rr RoomRequest) (*Room, error) {
+	// the rooms are annotated after mu is unlocked
+	annotate := false
+	defer func() {
+		if annotate {
+			ge.annotateRooms()
+		}
+	}()
+	ge.mu.Lock()
+	defer ge.mu.Unlock()
+
+	var room *Room
+	if rr.Name != "" {
+		err := api.ValidateRoomName(rr.Name)
+		if err != nil {
+			return nil, err
+		}
+		room = ge.findNamedRoom(rr.Name)
+		if room != nil {
+			if room.code != "" && subtle.ConstantTimeCompare([]byte(room.code), []byte(rr.Code)) != 1 {
+				return nil, fmt.Errorf("wrong join code for room '%s'", rr.Name)
+			}
+			err = room.accepts(spectate)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if spectate {
+			room = ge.findRunningRoom()
+		}
+		if room == nil {
+			room = ge.findOpenRoom()
+		}
+	}
+	if room == nil {
+		if len(ge.Rooms) >= ge.maxRooms {
+			return nil, fmt.Errorf("room limit reached (%d)", ge.maxRooms)
+		}
+		room = NewRoom(ge.config)
+		room.Name = rr.Name
+		room.code = rr.Code
+		ge.setupRoom(room)
+		ge.Rooms = append(ge.Rooms, room)
+		log.Printf("Create room %s %s(%d rooms)", room.ID, room.describe(), len(ge.Rooms))
+		annotate = room.Name != ""
+		go room.run(ge)
+	}
+
+	// rooms are closed only with ge.mu held, so the room found above is still open
+	room.reserve()
+	return room, nil
+}
+
+// Resume hands the connection to the client of the token, which keeps its player in the room.
+// The options of the new hello must be those of the session, because frames in the send buffer are already encoded.
+func (ge *GameEngine) Resume(token string, opts ClientOptions, conn *websocket.Conn) error {
+	ge.mu.Lock()
+	s, ok := ge.sessions[token]
+	ge.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown session")
+	}
+	if opts != s.client.Options() {
+		return fmt.Errorf("options %+v differ from %+v of the session", opts, s.client.Options())
+	}
+
+	err := s.client.Resume(conn)
+	if err != nil {
+		return err
+	}
+	resp := &api.InitResponse{
+		Status:    api.GameStatusInit,
+		ID:        s.client.ID(),
+		Config:    s.room.Config.Protocol(),
+		Spectator: s.spectate,
+		Token:     token,
+	}
+	err = sendFrame(s.client, resp)
+	if err != nil {
+		return err
+	}
+	s.room.Update(TriggerArgument{
+		EventType: EventClientResume,
+		Client:    s.client,
+	})
+	return nil
+}
+
+// Update forgets the session when the client has left for good.
+func (ge *GameEngine) Update(data interface{}) error {
+	ta := data.(TriggerArgument)
+	if ta.EventType != EventClientFinish {
+		return nil
+	}
+
+	ge.mu.Lock()
+	defer ge.mu.Unlock()
+	delete(ge.sessions, ta.Client.Token())
+	return nil
+}
+
+// DeleteRoom removes the room from the registry, and stops the room goroutine.
+// A room which has clients on the way is closed at once, and its goroutine stops after refusing them.
+// When the server is allocated and the last room is removed, the server shuts down.
+// It must be called from the room goroutine.
+func (ge *GameEngine) DeleteRoom(room *Room) {
+	if room.Name != "" {
+		// the rooms are annotated after mu is unlocked
+		defer ge.annotateRooms()
+	}
+	ge.mu.Lock()
+	defer ge.mu.Unlock()
+
+	room.mu.Lock()
+	room.closed = true
+	room.deleted = room.pending == 0
+	room.mu.Unlock()
+
+	for i, r := range ge.Rooms {
+		if r == room {
+			ge.Rooms = append(ge.Rooms[:i], ge.Rooms[i+1:]...)
+			log.Printf("Delete room %s (%d rooms)", room.ID, len(ge.Rooms))
+			break
+		}
+	}
+
+	if ge.allocated && len(ge.Rooms) == 0 {
+		err := ge.fw.Shutdown()
+		if err != nil {
+			log.Fatalf("Agones SDK: Failed to Shutdown: %v", err)
+		}
+	}
+}
+
+// findOpenRoom returns a public room which waits for players. Named rooms are left to their friends.
+func (ge *GameEngine) findOpenRoom() *Room {
+	for _, r := range ge.Rooms {
+		if r.Name == "" && r.IsOpen() {
+			return r
+		}
+	}
+	return nil
+}
+
+// findRunningRoom returns a running match which anyone can watch.
+func (ge *GameEngine) findRunningRoom() *Room {
+	for _, r := range ge.Rooms {
+		if r.code == "" && r.IsRunning() {
+			return r
 		}
 	}
+	return nil
+}
+
+func (ge *GameEngine) findNamedRoom(name string) *Room {
+	for _, r := range ge.Rooms {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
 }
 
-func (ge *GameEngine) ReachMaxClient() bool {
-	return len(ge.Clients) >= PlayerNum
+// annotateRooms publishes the names of the rooms, so that the backend finds the server of a named room.
+// It must be called without ge.mu held, because the SDK call may be slow.
+// The names are read after waiting for the last annotation, so that a stale list never overwrites a newer one.
+func (ge *GameEngine) annotateRooms() {
+	ge.annotateMu.Lock()
+	defer ge.annotateMu.Unlock()
+
+	names := make([]string, 0)
+	ge.mu.Lock()
+	for _, r := range ge.Rooms {
+		if r.Name != "" {
+			names = append(names, r.Name)
+		}
+	}
+	ge.mu.Unlock()
+	err := ge.fw.SetAnnotation(api.RoomsAnnotation, strings.Join(names, ","))
+	if err != nil {
+		log.Printf("[Error] Agones SDK: Failed to annotate rooms: %v", err)
+	}
+}
+
+// startRoom starts the match in the room.
+// The server is allocated once every room slot is busy, so that no more players are routed to it.
+// It must be called from the room goroutine.
+func (ge *GameEngine) startRoom(room *Room) {
+	room.stopBots()
+	room.stopCountdown()
+	room.ExecuteIngame(ge.newRecorder(room))
+	room.publish()
+
+	ge.mu.Lock()
+	defer ge.mu.Unlock()
+	if ge.allocated || len(ge.Rooms) < ge.maxRooms || ge.findOpenRoom() != nil {
+		return
+	}
+	err := ge.fw.Allocate()
+	if err != nil {
+		log.Fatalf("Agones SDK: Failed to Allocate: %v", err)
+	}
+	ge.allocated = true
 }
 
-func (ge *GameEngine) ExecuteIngame() {
-	players := make([]*Player, len(ge.Clients))
-	for i, c := range ge.Clients {
-		players[i] = NewPlayer(c, c.Stream(), Width, Height)
+func (ge *GameEngine) newRecorder(room *Room) Recorder {
+	if ge.replayDir == "" {
+		return &NopRecorder{}
 	}
-	event := make(chan Event)
 
-	ge.Ingame = NewGame(Width, Height, event, players)
-	go ge.Ingame.Run()
+	name := room.ID
+	if room.matches > 0 {
+		// rematches in the same room
+		name = fmt.Sprintf("%s-%d", room.ID, room.matches+1)
+	}
+	path := filepath.Join(ge.replayDir, name+".ndjson")
+	r, err := NewFileRecorder(path)
+	if err != nil {
+		log.Printf("[Error] create replay %s: %v", path, err)
+		return &NopRecorder{}
+	}
+	log.Printf("Room %s record replay to %s", room.ID, path)
+	return r
 }
 
 const (
 	SceneMatchmaking = iota
 	SceneIngame
+	// SceneResult waits for players to ask for a rematch
+	SceneResult
 )
 
+// ClientOptions are what the client asked for when it connected.
+type ClientOptions struct {
+	// Delta is true if the client applies delta frames
+	Delta bool
+	// Encoding is the encoding of frames and requests. Empty means api.EncodingJSON.
+	Encoding string
+}
+
+// Codec returns the codec of the encoding. The encoding is checked when the client connects.
+func (o ClientOptions) Codec() api.Codec {
+	codec, err := api.NewCodec(o.Encoding)
+	if err != nil {
+		return api.JSONCodec{}
+	}
+	return codec
+}
+
+// sendFrame encodes the frame in the encoding of the client, and sends it.
+func sendFrame(c Client, v interface{}) error {
+	data, err := c.Options().Codec().Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Send(data)
+}
+
+// decodeRequest decodes the request from the client.
+func decodeRequest(c Client, data []byte) (api.EventRequest, error) {
+	var req api.EventRequest
+	err := c.Options().Codec().Unmarshal(data, &req)
+	return req, err
+}
+
 type Client interface {
 	ID() string
+	Options() ClientOptions
+	// Token returns the token to resume the session, or empty if the client can not resume
+	Token() string
 	Send(data []byte) error
 	Close()
 	Stream() chan []byte
+	// Latency returns the round-trip time to the client, or 0 if it is unknown
+	Latency() time.Duration
 }
 
 type Scene struct {
@@ -163,44 +462,111 @@ func (mng *SceneManager) addScene(sceneID int) {
 	mng.Scenes = append(mng.Scenes, scene)
 }
 
+// NoOwner is the owner of cells which are not a part of snakes.
+const NoOwner = -1
+
+// Board is the grid of a match.
+// board has the remaining lifetime of each snake cell (or api.CellApple, api.CellWall),
+// and owner has the index of the player who owns each snake cell.
 type Board struct {
 	board  [][]int
+	owner  [][]int
 	width  int
 	height int
+	// torus wraps edges to the opposite side
+	torus bool
+	// appleCells are the cells where apples are spawned. If empty, apples are spawned anywhere.
+	appleCells []api.Point
+	// buried are the cells of snakes which passed through a body, and surface when the body above leaves
+	buried map[api.Point]buriedCell
+	rng    *rand.Rand
 }
 
-func NewBoard(w, h int) *Board {
+type buriedCell struct {
+	life  int
+	owner int
+}
+
+func NewBoard(w, h int, rng *rand.Rand) *Board {
 	board := make([][]int, h)
+	owner := make([][]int, h)
 	for i := range board {
 		board[i] = make([]int, w)
+		owner[i] = make([]int, w)
+		for j := range owner[i] {
+			owner[i][j] = NoOwner
+		}
 	}
 	return &Board{
 		board:  board,
+		owner:  owner,
 		width:  w,
 		height: h,
+		rng:    rng,
 	}
 }
 
+// Reset clears snakes, apples and items for the next match. Walls are left as they are.
 func (b *Board) Reset() {
 	for y := 0; y < b.height; y++ {
 		for x := 0; x < b.width; x++ {
-			if b.board[y][x] > 0 {
-				b.board[y][x] = 0
+			if b.board[y][x] != api.CellWall {
+				b.board[y][x] = api.CellEmpty
 			}
+			b.owner[y][x] = NoOwner
 		}
 	}
+	b.buried = nil
 }
 
 func (b *Board) GenerateApple() {
-	for {
-		x := rand.Intn(b.width)
-		y := rand.Intn(b.height)
+	x, y, ok := b.RandomEmptyCell()
+	if !ok {
+		log.Printf("No room for an apple")
+		return
+	}
+	b.SetCell(x, y, api.CellApple)
+}
 
-		if b.GetCell(x, y) == 0 {
-			b.SetCell(x, y, -1)
-			return
+// RandomEmptyCell returns an empty cell where apples and items can be spawned.
+// randomCell returns an empty cell anywhere on the board, regardless of apple zones.
+// It tries random cells as many as the cells, and then looks for the rest of cells in order.
+func (b *Board) randomCell() (int, int, bool) {
+	for i := 0; i < b.width*b.height; i++ {
+		x := b.rng.Intn(b.width)
+		y := b.rng.Intn(b.height)
+		if b.GetCell(x, y) == api.CellEmpty {
+			return x, y, true
+		}
+	}
+	for y := 0; y < b.height; y++ {
+		for x := 0; x < b.width; x++ {
+			if b.GetCell(x, y) == api.CellEmpty {
+				return x, y, true
+			}
 		}
 	}
+	return 0, 0, false
+}
+
+func (b *Board) RandomEmptyCell() (int, int, bool) {
+	if len(b.appleCells) > 0 {
+		for i := 0; i < len(b.appleCells); i++ {
+			c := b.appleCells[b.rng.Intn(len(b.appleCells))]
+			if b.GetCell(c.X, c.Y) == api.CellEmpty {
+				return c.X, c.Y, true
+			}
+		}
+		// the zones are crowded, so look for the rest of cells in order
+		for _, c := range b.appleCells {
+			if b.GetCell(c.X, c.Y) == api.CellEmpty {
+				return c.X, c.Y, true
+			}
+		}
+		return 0, 0, false
+	}
+
+	return b.randomCell()
 }
 
 func (b *Board) Update() {
@@ -208,13 +574,92 @@ func (b *Board) Update() {
 		for j := 0; j < b.width; j++ {
 			if b.board[i][j] > 0 {
 				b.board[i][j]--
+				if b.board[i][j] == 0 {
+					b.owner[i][j] = NoOwner
+				}
+			}
+		}
+	}
+	for p, c := range b.buried {
+		b.decayBuried(p, c, 1)
+	}
+	b.surface()
+}
+
+// DecayOwner makes the snake of the owner older by a tick, in addition to Update.
+func (b *Board) DecayOwner(owner int) {
+	b.ShrinkBody(owner, 1)
+}
+
+// ShrinkBody removes n cells from the tail of the owner's snake.
+func (b *Board) ShrinkBody(owner, n int) {
+	for i := 0; i < b.height; i++ {
+		for j := 0; j < b.width; j++ {
+			if b.owner[i][j] != owner {
+				continue
 			}
+			b.board[i][j] -= n
+			if b.board[i][j] <= 0 {
+				b.board[i][j] = 0
+				b.owner[i][j] = NoOwner
+			}
+		}
+	}
+	for p, c := range b.buried {
+		if c.owner == owner {
+			b.decayBuried(p, c, n)
+		}
+	}
+	b.surface()
+}
+
+// Bury keeps the cell of a snake which passes through the body on the cell, until the body leaves it.
+func (b *Board) Bury(x, y, life, owner int) {
+	if b.buried == nil {
+		b.buried = make(map[api.Point]buriedCell)
+	}
+	b.buried[api.Point{X: x, Y: y}] = buriedCell{life: life, owner: owner}
+}
+
+func (b *Board) decayBuried(p api.Point, c buriedCell, n int) {
+	c.life -= n
+	if c.life <= 0 {
+		delete(b.buried, p)
+		return
+	}
+	b.buried[p] = c
+}
+
+// surface puts buried cells back on the board where the body above has left.
+func (b *Board) surface() {
+	for p, c := range b.buried {
+		if b.board[p.Y][p.X] == api.CellEmpty {
+			b.SetBody(p.X, p.Y, c.life, c.owner)
+			delete(b.buried, p)
 		}
 	}
 }
 
+func (b *Board) Contains(x, y int) bool {
+	return x >= 0 && x < b.width && y >= 0 && y < b.height
+}
+
+// Wrap returns the cell on the board for (x, y) next to the board.
+// On a torus board, it is wrapped to the opposite side.
+// Otherwise it returns false if the cell is out of the board.
+func (b *Board) Wrap(x, y int) (int, int, bool) {
+	if b.torus {
+		return (x + b.width) % b.width, (y + b.height) % b.height, true
+	}
+	return x, y, b.Contains(x, y)
+}
+
 func (b *Board) HitApple(x, y int) bool {
-	return b.board[y][x] == -1
+	return b.board[y][x] == api.CellApple
+}
+
+func (b *Board) HitWall(x, y int) bool {
+	return b.board[y][x] == api.CellWall
 }
 
 func (b *Board) GetCell(x, y int) int {
@@ -223,6 +668,61 @@ func (b *Board) GetCell(x, y int) int {
 
 func (b *Board) SetCell(x, y, data int) {
 	b.board[y][x] = data
+	b.owner[y][x] = NoOwner
+}
+
+// SetBody sets a snake cell which lives for life ticks.
+func (b *Board) SetBody(x, y, life, owner int) {
+	if life <= 0 {
+		b.SetCell(x, y, 0)
+		return
+	}
+	b.board[y][x] = life
+	b.owner[y][x] = owner
+}
+
+// GetOwner returns the index of the player who owns the cell, or NoOwner.
+func (b *Board) GetOwner(x, y int) int {
+	return b.owner[y][x]
+}
+
+// Bodies returns the cells of each owner ordered from head to tail.
+func (b *Board) Bodies() map[int][]api.Point {
+	lives := make(map[int][]int)
+	bodies := make(map[int][]api.Point)
+	for y := 0; y < b.height; y++ {
+		for x := 0; x < b.width; x++ {
+			o := b.owner[y][x]
+			if o == NoOwner {
+				continue
+			}
+			bodies[o] = append(bodies[o], api.Point{X: x, Y: y})
+			lives[o] = append(lives[o], b.board[y][x])
+		}
+	}
+	// a snake which passed through a body is drawn whole
+	for p, c := range b.buried {
+		bodies[c.owner] = append(bodies[c.owner], p)
+		lives[c.owner] = append(lives[c.owner], c.life)
+	}
+
+	// the longer a cell lives, the closer it is to the head
+	for o := range bodies {
+		sort.Sort(&bodyOrder{points: bodies[o], lives: lives[o]})
+	}
+	return bodies
+}
+
+type bodyOrder struct {
+	points []api.Point
+	lives  []int
+}
+
+func (s *bodyOrder) Len() int           { return len(s.points) }
+func (s *bodyOrder) Less(i, j int) bool { return s.lives[i] > s.lives[j] }
+func (s *bodyOrder) Swap(i, j int) {
+	s.points[i], s.points[j] = s.points[j], s.points[i]
+	s.lives[i], s.lives[j] = s.lives[j], s.lives[i]
 }
 
 func (b *Board) ToArray() []int {
@@ -242,67 +742,301 @@ type Event struct {
 	Direction int
 }
 
-func NewGame(w, h int, ev chan Event, players []*Player) *Game {
-	board := NewBoard(w, h)
-	board.GenerateApple()
-	for _, p := range players {
-		p.GenerateSnake(board)
+// NewGame creates a match. Every random decision of the match is drawn from the seed,
+// so the same seed and the same inputs always produce the same match.
+func NewGame(cfg *GameConfig, seed int64, ev chan Event, players []*Player) *Game {
+	return newGame(cfg, seed, ev, players, NewBoard(cfg.Width, cfg.Height, nil))
+}
+
+// Rematch starts a new match on the board of the finished match.
+// The new match is the same as a match created by NewGame with the seed.
+func (game *Game) Rematch(seed int64, ev chan Event, players []*Player) *Game {
+	game.board.Reset()
+	return newGame(game.config, seed, ev, players, game.board)
+}
+
+func newGame(cfg *GameConfig, seed int64, ev chan Event, players []*Player, board *Board) *Game {
+	rng := rand.New(rand.NewSource(seed))
+	board.rng = rng
+	board.torus = cfg.Topology == api.TopologyTorus
+	var spawns []Spawn
+	if cfg.gameMap != nil {
+		cfg.gameMap.Apply(board)
+		spawns = cfg.gameMap.Spawns
+	}
+
+	// teams are drawn only in team matches, so that matches without teams are the same as before
+	assignTeams(players, cfg.Teams, rng)
+
+	// spawn points are assigned at random, so that the connection order does not matter
+	perm := rng.Perm(len(spawns))
+	for i, p := range players {
+		p.index = i
+		var err error
+		if i < len(spawns) {
+			err = p.SpawnAt(board, spawns[perm[i]])
+			if err != nil {
+				// a snake spawned before may lie across the spawn point
+				log.Printf("[Error] %v, spawn at random", err)
+				err = p.Spawn(board)
+			}
+		} else {
+			err = p.Spawn(board)
+		}
+		if err != nil {
+			// the config is validated for the room of snakes, so this happens only on a crowded board
+			log.Printf("[Error] %v", err)
+			p.Die(0)
+		}
+	}
+	for i := 0; i < cfg.AppleNum; i++ {
+		board.GenerateApple()
+	}
+
+	directions := make([]int, len(players))
+	for i, p := range players {
+		directions[i] = p.direction
 	}
 
 	return &Game{
-		board:   board,
-		event:   ev,
-		players: players,
+		config:     cfg,
+		seed:       seed,
+		board:      board,
+		event:      ev,
+		players:    players,
+		directions: directions,
+		recorder:   &NopRecorder{},
+		synced:     make(map[string]bool),
 	}
 }
 
 // Game manages the board informations, user status and game logic.
 // This game is for single-player, so Game manage player's event.
 type Game struct {
+	config  *GameConfig
+	seed    int64
+	tick    int
 	board   *Board
 	event   chan Event
 	players []*Player
+	// directions are the last directions each player moved to, used to record direction changes
+	directions []int
+	items      []*Item
+	finished   bool
+	recorder   Recorder
+	spectators []*Spectator
+	// last is the snapshot of the last tick, from which delta frames are made
+	last *api.EventResponse
+	// synced has IDs of clients which received a keyframe, so that delta frames can be applied
+	synced map[string]bool
+}
+
+// SetRecorder sets the recorder which receives the match seed, config and every direction change.
+func (game *Game) SetRecorder(r Recorder) {
+	game.recorder = r
 }
 
-func (game *Game) Run() {
-	t := time.NewTicker(time.Millisecond * 100)
-	defer t.Stop()
+// Start records the beginning of the match. The room calls step every tick after this.
+func (game *Game) Start() {
+	game.recorder.Start(game.Meta())
+}
+
+func (game *Game) AddSpectator(s *Spectator) {
+	game.spectators = append(game.spectators, s)
+}
+
+func (game *Game) DeleteSpectator(sid string) {
+	for i, s := range game.spectators {
+		if s.ID() == sid {
+			game.spectators = append(game.spectators[:i], game.spectators[i+1:]...)
+			return
+		}
+	}
+}
+
+func (game *Game) Spectators() []*Spectator {
+	return game.spectators
+}
+
+// finish records the end of the match and sends the result to every participant.
+// Spectators are disconnected, and players are left to the room for a rematch.
+func (game *Game) finish() {
+	game.recorder.Finish(game.tick)
+
+	result := game.Result()
+	for _, p := range game.players {
+		sendFrame(p.Client, result)
+	}
+	for _, s := range game.spectators {
+		sendFrame(s.Client, result)
+		// Close notifies the room, so it must not be called from the room goroutine
+		go s.Client.Close()
+	}
+	game.spectators = nil
+}
+
+func (game *Game) Response(status int) *api.EventResponse {
+	return NewEventResponse(status, game.tick, game.board, game.players)
+}
+
+// step advances the match by one tick.
+// Every player is treated at once regardless of the order of players:
+//  1. collect the direction of every player
+//  2. compute every next head
+//  3. resolve collisions together
+//  4. broadcast one snapshot of the tick
+//
+// It returns true when the match is finished.
+func (game *Game) step() bool {
+	game.tick++
+
+	// collect inputs
+	alive := make([]int, 0, len(game.players))
+	for i, p := range game.players {
+		if p.State == 1 {
+			continue
+		}
+		alive = append(alive, i)
+		p.NextTurn(game.directions[i])
+		if p.direction != game.directions[i] {
+			game.directions[i] = p.direction
+			game.recorder.Turn(game.tick, p.ID(), p.direction)
+		}
+	}
+
+	// Tails move away in this tick, so a head can follow a tail.
+	game.board.Update()
+	game.expireItems()
+	dead := make(map[int]error)
+	game.moveSnakes(alive, dead)
+
+	// snakes with speed boost move again
+	boosted := make([]int, 0)
+	for _, i := range alive {
+		if dead[i] == nil && game.players[i].HasEffect(ItemSpeed, game.tick) {
+			game.board.DecayOwner(i)
+			boosted = append(boosted, i)
+		}
+	}
+	if len(boosted) > 0 {
+		game.moveSnakes(boosted, dead)
+	}
+	game.spawnItems()
+
+	for _, i := range alive {
+		if err := dead[i]; err != nil {
+			p := game.players[i]
+			log.Printf("Move error(%v) to client: %s", err, p.ID())
+			p.Die(game.tick)
+		}
+	}
+	game.finished = game.isOver()
+
+	// broadcast
+	// dead players keep receiving frames to watch the rest of the match
+	game.broadcast()
+
+	return game.isFinish()
+}
 
-	for range t.C {
-		for _, p := range game.players {
-			if p.State == 1 {
+// moveSnakes moves the snakes of movers at once.
+// It computes every next head, and then resolves collisions together.
+// Players who die are added to dead with the reason.
+func (game *Game) moveSnakes(movers []int, dead map[int]error) {
+	heads := make(map[int][2]int, len(movers))
+	for _, i := range movers {
+		x, y, ok := game.board.Wrap(game.players[i].Next())
+		if !ok {
+			dead[i] = fmt.Errorf("out of border")
+		}
+		heads[i] = [2]int{x, y}
+	}
+
+	// resolve collisions
+	for _, i := range movers {
+		if dead[i] != nil {
+			continue
+		}
+		p := game.players[i]
+		ghost := p.HasEffect(ItemGhost, game.tick)
+		head := heads[i]
+		if game.board.HitWall(head[0], head[1]) {
+			dead[i] = fmt.Errorf("hit wall")
+			continue
+		}
+		if game.board.GetCell(head[0], head[1]) > 0 && !ghost {
+			owner := game.board.GetOwner(head[0], head[1])
+			if owner == NoOwner || !game.passThrough(i, owner) {
+				dead[i] = fmt.Errorf("stamp snake")
+				if owner != NoOwner {
+					p.Kill(game.players[owner])
+				}
 				continue
 			}
-			err := p.Send(api.GameStatusOK, game.board, game.players)
-			if err != nil {
-				log.Printf("Send error(%v) to client: %s", err, p.ID())
-				// player sends close event if player lost
-				// So we ignore this error
+		}
+		for _, j := range movers {
+			if i == j || ghost || game.players[j].HasEffect(ItemGhost, game.tick) || game.passThrough(i, j) {
 				continue
 			}
-			err = p.Move(game.board)
-
-			if err != nil {
-				log.Printf("Move error(%v) to client: %s", err, p.ID())
-
-				p.Send(api.GameStatusError, game.board, game.players)
-				p.Finish()
+			if head == heads[j] {
+				dead[i] = fmt.Errorf("head-on collision")
+				p.Kill(game.players[j])
+				break
 			}
+		}
+	}
 
-			if game.isFinish() {
-				log.Println("--- Game finished!!")
-				return
-			}
+	apples := 0
+	for _, i := range movers {
+		if dead[i] != nil {
+			continue
+		}
+		p := game.players[i]
+		head := heads[i]
+		if game.board.HitApple(head[0], head[1]) {
+			apples++
+			p.size += game.config.GrowthPerApple
+			p.score += game.config.GrowthPerApple * p.Multiplier(game.tick)
+			game.board.SetCell(head[0], head[1], api.CellEmpty)
+		}
+		game.pickItem(p, head[0], head[1])
+
+		if game.board.GetCell(head[0], head[1]) > 0 {
+			// a ghost or a teammate passes through the body without overwriting it
+			game.board.Bury(head[0], head[1], p.size, p.index)
+			p.x = head[0]
+			p.y = head[1]
+			continue
 		}
-		game.board.Update()
+		p.MoveTo(game.board, head[0], head[1])
+	}
+	for i := 0; i < apples; i++ {
+		game.board.GenerateApple()
 	}
 }
 
-func (game *Game) isFinish() bool {
-	for _, p := range game.players {
-		if p.State == 0 {
-			return false
-		}
+// MatchMeta is the information to reproduce a match.
+type MatchMeta struct {
+	Seed    int64      `json:"seed"`
+	Config  GameConfig `json:"config"`
+	Map     *GameMap   `json:"map,omitempty"`
+	Players []string   `json:"players"`
+}
+
+func (game *Game) Meta() MatchMeta {
+	ids := make([]string, len(game.players))
+	for i, p := range game.players {
+		ids[i] = p.ID()
+	}
+	return MatchMeta{
+		Seed:    game.seed,
+		Config:  *game.config,
+		Map:     game.config.gameMap,
+		Players: ids,
 	}
-	return true
+}
+
+// isFinish reports whether the match has finished by the win condition.
+func (game *Game) isFinish() bool {
+	return game.finished
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/myoan/snake/api"
+)
+
+type DummyClient struct {
+	id     string
+	stream chan []byte
+}
+
+func NewDummyClient(id string) *DummyClient {
+	return &DummyClient{
+		id:     id,
+		stream: make(chan []byte),
+	}
+}
+
+func (c *DummyClient) ID() string             { return c.id }
+func (c *DummyClient) Token() string          { return "" }
+func (c *DummyClient) Options() ClientOptions { return ClientOptions{} }
+func (c *DummyClient) Send(data []byte) error { return nil }
+func (c *DummyClient) Close()                 {}
+func (c *DummyClient) Stream() chan []byte    { return c.stream }
+func (c *DummyClient) Latency() time.Duration { return 0 }
+
+func newDummyGame(cfg *GameConfig, seed int64) *Game {
+	players := make([]*Player, cfg.PlayerNum)
+	for i := range players {
+		c := NewDummyClient(string(rune('a' + i)))
+		players[i] = NewPlayer(c, cfg)
+	}
+	return NewGame(cfg, seed, make(chan Event), players)
+}
+
+func TestNewGame_SameSeed(t *testing.T) {
+	cfg := DefaultGameConfig()
+	g1 := newDummyGame(cfg, 42)
+	g2 := newDummyGame(cfg, 42)
+
+	for i := 0; i < 20; i++ {
+		f1 := g1.step()
+		f2 := g2.step()
+		if f1 != f2 {
+			t.Fatalf("tick %d: finish differs: %v, %v", i, f1, f2)
+		}
+		if f1 {
+			break
+		}
+	}
+
+	if !reflect.DeepEqual(g1.board.ToArray(), g2.board.ToArray()) {
+		t.Errorf("boards differ with the same seed")
+	}
+}
+
+func TestNewGame_DifferentSeed(t *testing.T) {
+	cfg := DefaultGameConfig()
+	g1 := newDummyGame(cfg, 1)
+	g2 := newDummyGame(cfg, 2)
+
+	if reflect.DeepEqual(g1.board.ToArray(), g2.board.ToArray()) {
+		t.Errorf("boards should differ with different seeds")
+	}
+}
+
+// newEmptyGame returns a game whose board has no snakes and apples, so that tests can put snakes by hand.
+func newEmptyGame(cfg *GameConfig) *Game {
+	game := newDummyGame(cfg, 1)
+	game.board = NewBoard(cfg.Width, cfg.Height, rand.New(rand.NewSource(1)))
+	game.board.torus = cfg.Topology == api.TopologyTorus
+	return game
+}
+
+func putSnake(game *Game, i, x, y, direction int) {
+	p := game.players[i]
+	p.x = x
+	p.y = y
+	p.direction = direction
+	game.directions[i] = direction
+	game.board.SetBody(x, y, p.size, i)
+}
+
+func TestGame_Step_HeadOn(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	putSnake(game, 1, 12, 10, api.MoveLeft)
+
+	finished := game.step()
+
+	if !finished {
+		t.Errorf("both players should die by moving into the same cell")
+	}
+}
+
+func TestGame_Step_Swap(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	putSnake(game, 1, 11, 10, api.MoveLeft)
+
+	finished := game.step()
+
+	if !finished {
+		t.Errorf("both players should die by swapping heads")
+	}
+}
+
+func TestGame_Step_FollowTail(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	putSnake(game, 1, 20, 20, api.MoveRight)
+	// the tail of player 1 leaves (11, 10) in this tick
+	game.board.SetBody(11, 10, 1, 1)
+
+	game.step()
+
+	if game.players[0].State != 0 {
+		t.Errorf("player should be able to follow the tail")
+	}
+	if game.players[0].x != 11 || game.players[0].y != 10 {
+		t.Errorf("head: expected (11, 10), but got (%d, %d)", game.players[0].x, game.players[0].y)
+	}
+}
+
+func TestGame_Step_KilledBy(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	putSnake(game, 1, 20, 20, api.MoveRight)
+	game.board.SetBody(11, 10, 2, 1)
+
+	game.step()
+
+	if game.players[0].killedBy != game.players[1].ID() {
+		t.Errorf("killedBy: expected %s, but got '%s'", game.players[1].ID(), game.players[0].killedBy)
+	}
+}
+
+func TestBoard_Bodies(t *testing.T) {
+	board := NewBoard(5, 5, rand.New(rand.NewSource(1)))
+	board.SetBody(1, 1, 1, 0)
+	board.SetBody(3, 1, 3, 0)
+	board.SetBody(2, 1, 2, 0)
+	board.SetBody(0, 0, 1, 1)
+
+	bodies := board.Bodies()
+
+	expected := []api.Point{{X: 3, Y: 1}, {X: 2, Y: 1}, {X: 1, Y: 1}}
+	if !reflect.DeepEqual(bodies[0], expected) {
+		t.Errorf("body: expected %v, but got %v", expected, bodies[0])
+	}
+	if len(bodies[1]) != 1 {
+		t.Errorf("body: expected 1 cell, but got %v", bodies[1])
+	}
+}
+
+func TestGame_Step_Torus(t *testing.T) {
+	cfg := DefaultGameConfig()
+	cfg.Topology = api.TopologyTorus
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, cfg.Width-1, 10, api.MoveRight)
+	putSnake(game, 1, 20, 20, api.MoveRight)
+
+	game.step()
+
+	if game.players[0].State != 0 {
+		t.Errorf("player should wrap to the opposite side")
+	}
+	if game.players[0].x != 0 || game.players[0].y != 10 {
+		t.Errorf("head: expected (0, 10), but got (%d, %d)", game.players[0].x, game.players[0].y)
+	}
+}
+
+func TestGame_Rematch(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newDummyGame(cfg, 3)
+	for i := 0; i < 10; i++ {
+		game.step()
+	}
+
+	players := make([]*Player, cfg.PlayerNum)
+	for i := range players {
+		players[i] = NewPlayer(game.players[i].Client, cfg)
+	}
+	rematch := game.Rematch(5, make(chan Event), players)
+	fresh := newDummyGame(cfg, 5)
+
+	if rematch.board != game.board {
+		t.Errorf("rematch should reuse the board")
+	}
+	if !reflect.DeepEqual(rematch.board.ToArray(), fresh.board.ToArray()) {
+		t.Errorf("rematch board differs from a new match with the same seed")
+	}
+}
+
+func TestGame_Step_InputQueue(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	putSnake(game, 1, 20, 20, api.MoveRight)
+	p := game.players[0]
+
+	// two quick turns in a tick must not turn around into the neck
+	p.Queue(api.MoveUp)
+	p.Queue(api.MoveLeft)
+
+	game.step()
+	if p.direction != api.MoveUp || p.x != 10 || p.y != 9 {
+		t.Errorf("tick 1: expected up to (10, 9), but got %d to (%d, %d)", p.direction, p.x, p.y)
+	}
+	game.step()
+	if p.direction != api.MoveLeft || p.x != 9 || p.y != 9 {
+		t.Errorf("tick 2: expected left to (9, 9), but got %d to (%d, %d)", p.direction, p.x, p.y)
+	}
+	if p.State != 0 {
+		t.Errorf("player should be alive")
+	}
+}
+
+func TestPlayer_NextTurn_Illegal(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	p := game.players[0]
+
+	p.Queue(api.MoveLeft)
+	p.Queue(api.MoveRight)
+	p.Queue(api.MoveDown)
+	p.NextTurn(api.MoveRight)
+
+	if p.direction != api.MoveDown {
+		t.Errorf("direction: expected %d, but got %d", api.MoveDown, p.direction)
+	}
+	if len(p.inputs) != 0 {
+		t.Errorf("illegal turns should be discarded, but %d left", len(p.inputs))
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/myoan/snake/api"
+)
+
+// GameMap is an arena which defines walls, spawn points and apple spawn zones.
+type GameMap struct {
+	Width  int         `json:"width"`
+	Height int         `json:"height"`
+	Walls  []api.Point `json:"walls"`
+	// Spawns are the cells where snakes are spawned. If empty, snakes are spawned at random cells.
+	Spawns []Spawn `json:"spawns"`
+	// AppleZones are the areas where apples are spawned. If empty, apples are spawned anywhere.
+	AppleZones []Zone `json:"apple_zones"`
+}
+
+type Spawn struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	// Direction is the initial direction. If nil, it is picked at random.
+	Direction *int `json:"direction,omitempty"`
+}
+
+type Zone struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// LoadGameMap loads a map from a JSON file (.json) or a text file.
+//
+// A text map is a grid of characters, one line per row:
+//
+//	'.' empty cell
+//	'#' wall
+//	'a' apple spawn zone
+//	'S' spawn point with random direction
+//	'<', '>', '^', 'v' spawn point with the direction
+//
+// Lines starting with ';' are comments.
+func LoadGameMap(path string) (*GameMap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m *GameMap
+	if filepath.Ext(path) == ".json" {
+		m = &GameMap{}
+		err = json.Unmarshal(data, m)
+	} else {
+		m, err = ParseTextMap(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse map %s: %v", path, err)
+	}
+
+	err = m.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid map %s: %v", path, err)
+	}
+	return m, nil
+}
+
+func ParseTextMap(data []byte) (*GameMap, error) {
+	m := &GameMap{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	y := 0
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if m.Width == 0 {
+			m.Width = len(line)
+		}
+		if len(line) != m.Width {
+			return nil, fmt.Errorf("line %d: width must be %d, but %d", y+1, m.Width, len(line))
+		}
+
+		for x, c := range line {
+			switch c {
+			case '.':
+			case '#':
+				m.Walls = append(m.Walls, api.Point{X: x, Y: y})
+			case 'a':
+				m.AppleZones = append(m.AppleZones, Zone{X: x, Y: y, Width: 1, Height: 1})
+			case 'S':
+				m.Spawns = append(m.Spawns, Spawn{X: x, Y: y})
+			case '<', '>', '^', 'v':
+				d := map[rune]int{'<': api.MoveLeft, '>': api.MoveRight, '^': api.MoveUp, 'v': api.MoveDown}[c]
+				m.Spawns = append(m.Spawns, Spawn{X: x, Y: y, Direction: &d})
+			default:
+				return nil, fmt.Errorf("line %d: unknown cell '%c'", y+1, c)
+			}
+		}
+		y++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	m.Height = y
+	return m, nil
+}
+
+func (m *GameMap) Validate() error {
+	if m.Width <= 0 || m.Height <= 0 {
+		return fmt.Errorf("size must be positive (%dx%d)", m.Width, m.Height)
+	}
+
+	walls := make(map[api.Point]bool)
+	for _, w := range m.Walls {
+		if !m.contains(w.X, w.Y) {
+			return fmt.Errorf("wall (%d, %d) is out of the map", w.X, w.Y)
+		}
+		walls[w] = true
+	}
+	spawns := make(map[api.Point]bool)
+	for _, s := range m.Spawns {
+		p := api.Point{X: s.X, Y: s.Y}
+		if !m.contains(s.X, s.Y) {
+			return fmt.Errorf("spawn (%d, %d) is out of the map", s.X, s.Y)
+		}
+		if walls[p] {
+			return fmt.Errorf("spawn (%d, %d) is on a wall", s.X, s.Y)
+		}
+		if spawns[p] {
+			return fmt.Errorf("spawn (%d, %d) is duplicated", s.X, s.Y)
+		}
+		spawns[p] = true
+		if s.Direction != nil && (*s.Direction < api.MoveLeft || *s.Direction > api.MoveDown) {
+			return fmt.Errorf("spawn (%d, %d) has unknown direction %d", s.X, s.Y, *s.Direction)
+		}
+	}
+	for _, z := range m.AppleZones {
+		if !m.contains(z.X, z.Y) || !m.contains(z.X+z.Width-1, z.Y+z.Height-1) {
+			return fmt.Errorf("apple zone (%d, %d, %d, %d) is out of the map", z.X, z.Y, z.Width, z.Height)
+		}
+	}
+	return nil
+}
+
+// WallCells returns the number of cells covered by walls.
+func (m *GameMap) WallCells() int {
+	walls := make(map[api.Point]bool)
+	for _, w := range m.Walls {
+		walls[w] = true
+	}
+	return len(walls)
+}
+
+func (m *GameMap) contains(x, y int) bool {
+	return x >= 0 && x < m.Width && y >= 0 && y < m.Height
+}
+
+// Apply puts walls and apple zones of the map on the board.
+func (m *GameMap) Apply(b *Board) {
+	for _, w := range m.Walls {
+		b.SetCell(w.X, w.Y, api.CellWall)
+	}
+
+	b.appleCells = nil
+	for _, z := range m.AppleZones {
+		for y := z.Y; y < z.Y+z.Height; y++ {
+			for x := z.X; x < z.X+z.Width; x++ {
+				if b.GetCell(x, y) != api.CellWall {
+					b.appleCells = append(b.appleCells, api.Point{X: x, Y: y})
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/myoan/snake/api"
+)
+
+func TestParseTextMap(t *testing.T) {
+	data := []byte(`; comment
+#####
+#>.a#
+#...#
+#####
+`)
+	m, err := ParseTextMap(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Width != 5 || m.Height != 4 {
+		t.Errorf("size: expected 5x4, but got %dx%d", m.Width, m.Height)
+	}
+	if len(m.Walls) != 14 {
+		t.Errorf("walls: expected 14, but got %d", len(m.Walls))
+	}
+	if len(m.Spawns) != 1 || *m.Spawns[0].Direction != api.MoveRight {
+		t.Errorf("spawns: expected one spawn to the right, but got %v", m.Spawns)
+	}
+	if len(m.AppleZones) != 1 {
+		t.Errorf("apple zones: expected 1, but got %d", len(m.AppleZones))
+	}
+}
+
+func TestParseTextMap_Invalid(t *testing.T) {
+	_, err := ParseTextMap([]byte("###\n##\n"))
+	if err == nil {
+		t.Errorf("ParseTextMap should return error if widths of lines differ")
+	}
+}
+
+func TestGameMap_Validate_Spawns(t *testing.T) {
+	tests := map[string][]Spawn{
+		"out of the map": {{X: 5, Y: 0}},
+		"on a wall":      {{X: 0, Y: 0}},
+		"duplicated":     {{X: 2, Y: 2}, {X: 2, Y: 2}},
+	}
+	for name, spawns := range tests {
+		m := &GameMap{Width: 5, Height: 5, Walls: []api.Point{{X: 0, Y: 0}}, Spawns: spawns}
+		if err := m.Validate(); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: expected error, but got %v", name, err)
+		}
+	}
+}
+
+func TestLoadGameMap(t *testing.T) {
+	m, err := LoadGameMap("maps/cross.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Width != 40 || m.Height != 40 || len(m.Spawns) != 4 {
+		t.Errorf("unexpected map: %dx%d, %d spawns", m.Width, m.Height, len(m.Spawns))
+	}
+}
+
+func TestGame_Step_HitWall(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	putSnake(game, 1, 20, 20, api.MoveRight)
+	game.board.SetCell(11, 10, api.CellWall)
+
+	game.step()
+
+	if game.players[0].State != 1 {
+		t.Errorf("player should die by hitting a wall")
+	}
+}
+
+func TestGameConfig_Validate_Walls(t *testing.T) {
+	m, err := ParseTextMap([]byte(strings.Repeat("##########\n", 9) + "#........#\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultGameConfig()
+	cfg.gameMap = m
+	cfg.Width = m.Width
+	cfg.Height = m.Height
+
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("Validate should return error if walls leave no room for snakes")
+	}
+}
+
+func TestPlayer_Spawn_Full(t *testing.T) {
+	board := NewBoard(5, 5, rand.New(rand.NewSource(1)))
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 5; x++ {
+			board.SetCell(x, y, api.CellWall)
+		}
+	}
+	p := NewPlayer(NewDummyClient("a"), DefaultGameConfig())
+
+	if err := p.Spawn(board); err == nil {
+		t.Errorf("Spawn should return error on a board without empty cells")
+	}
+
+	// the last empty cell is found even if random cells miss it
+	board.SetCell(4, 4, api.CellEmpty)
+	if err := p.Spawn(board); err != nil || p.x != 4 || p.y != 4 {
+		t.Errorf("expected to spawn at (4, 4), but got (%d, %d): %v", p.x, p.y, err)
+	}
+}
+
+func TestPlayer_SpawnAt_Occupied(t *testing.T) {
+	board := NewBoard(5, 5, rand.New(rand.NewSource(1)))
+	board.SetBody(2, 2, 2, 1)
+	p := NewPlayer(NewDummyClient("a"), DefaultGameConfig())
+
+	if err := p.SpawnAt(board, Spawn{X: 2, Y: 2}); err == nil {
+		t.Errorf("SpawnAt should return error on a body")
+	}
+	if board.GetCell(2, 2) != 2 {
+		t.Errorf("SpawnAt should not overwrite the body, but got %d", board.GetCell(2, 2))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/myoan/snake/api"
+)
+
+// Build information of the server, set by -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+// helloTimeout is how long the server waits for the hello after the connection is upgraded.
+const helloTimeout = 10 * time.Second
+
+func buildInfo() api.BuildInfo {
+	return api.BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// handshake reads the hello of the client, and answers with the welcome.
+// An incompatible client receives an error frame with the reason, and the connection is closed.
+func handshake(c *websocket.Conn, cfg *GameConfig) (*api.Hello, api.Codec, error) {
+	c.SetReadDeadline(time.Now().Add(helloTimeout))
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		c.Close()
+		return nil, nil, fmt.Errorf("read hello: %v", err)
+	}
+	c.SetReadDeadline(time.Time{})
+
+	var hello api.Hello
+	err = json.Unmarshal(data, &hello)
+	if err != nil {
+		return nil, nil, reject(c, fmt.Errorf("hello must be JSON: %v", err))
+	}
+	if hello.Version != api.ProtocolVersion {
+		return nil, nil, reject(c, fmt.Errorf("protocol version %d is not supported, the server speaks %d", hello.Version, api.ProtocolVersion))
+	}
+	encoding := api.ChooseEncoding(hello.Encodings)
+	if encoding == "" {
+		return nil, nil, reject(c, fmt.Errorf("no supported encoding in %v, the server supports %v", hello.Encodings, api.Encodings))
+	}
+	codec, _ := api.NewCodec(encoding)
+
+	welcome := &api.Welcome{
+		Status:    api.GameStatusWelcome,
+		Version:   api.ProtocolVersion,
+		Encoding:  encoding,
+		Encodings: api.Encodings,
+		Server:    buildInfo(),
+		Config:    cfg.Protocol(),
+
+		PingInterval: int(pingInterval / time.Millisecond),
+	}
+	err = writeFrame(c, api.JSONCodec{}, welcome)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return &hello, codec, nil
+}
+
+// reject sends the reason to the client in JSON, which every client can read, and closes the connection.
+func reject(c *websocket.Conn, err error) error {
+	writeFrame(c, api.JSONCodec{}, &api.EventResponse{
+		Status: api.GameStatusError,
+		Error:  err.Error(),
+	})
+	c.Close()
+	return err
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/myoan/snake/api"
+)
+
+// Kinds of items which can be picked up besides apples.
+const (
+	// ItemGrow grows the snake by Amount
+	ItemGrow = "grow"
+	// ItemShrink shrinks the snake by Amount
+	ItemShrink = "shrink"
+	// ItemSpeed makes the snake move twice a tick for Duration ticks
+	ItemSpeed = "speed"
+	// ItemGhost makes the snake pass through bodies for Duration ticks
+	ItemGhost = "ghost"
+	// ItemMultiplier multiplies the score of apples by Amount for Duration ticks
+	ItemMultiplier = "multiplier"
+)
+
+var itemCells = map[string]int{
+	ItemGrow:       api.CellItemGrow,
+	ItemShrink:     api.CellItemShrink,
+	ItemSpeed:      api.CellItemSpeed,
+	ItemGhost:      api.CellItemGhost,
+	ItemMultiplier: api.CellItemMultiplier,
+}
+
+// ItemConfig is the rule of a kind of item.
+type ItemConfig struct {
+	Kind string `json:"kind" yaml:"kind"`
+	// Rate is the chance to spawn the item in a tick
+	Rate float64 `json:"rate" yaml:"rate"`
+	// Lifetime is the ticks the item stays on the board. 0 means forever.
+	Lifetime int `json:"lifetime" yaml:"lifetime"`
+	// Duration is the ticks the effect lasts
+	Duration int `json:"duration" yaml:"duration"`
+	// Amount is the cells to grow or shrink, or the factor of the multiplier
+	Amount int `json:"amount" yaml:"amount"`
+}
+
+func (ic *ItemConfig) Validate() error {
+	if _, ok := itemCells[ic.Kind]; !ok {
+		return fmt.Errorf("unknown item kind '%s'", ic.Kind)
+	}
+	if ic.Rate < 0 || ic.Rate > 1 {
+		return fmt.Errorf("item %s: rate must be in [0, 1] (%v)", ic.Kind, ic.Rate)
+	}
+	if ic.Lifetime < 0 {
+		return fmt.Errorf("item %s: lifetime must not be negative (%d)", ic.Kind, ic.Lifetime)
+	}
+	switch ic.Kind {
+	case ItemGrow, ItemShrink:
+		if ic.Amount < 1 {
+			return fmt.Errorf("item %s: amount must be positive (%d)", ic.Kind, ic.Amount)
+		}
+	case ItemSpeed, ItemGhost:
+		if ic.Duration < 1 {
+			return fmt.Errorf("item %s: duration must be positive (%d)", ic.Kind, ic.Duration)
+		}
+	case ItemMultiplier:
+		if ic.Duration < 1 || ic.Amount < 1 {
+			return fmt.Errorf("item %s: duration and amount must be positive (%d, %d)", ic.Kind, ic.Duration, ic.Amount)
+		}
+	}
+	return nil
+}
+
+func (ic *ItemConfig) Protocol() api.ItemConfig {
+	return api.ItemConfig{
+		Kind:     ic.Kind,
+		Rate:     ic.Rate,
+		Lifetime: ic.Lifetime,
+		Duration: ic.Duration,
+		Amount:   ic.Amount,
+	}
+}
+
+// Item is an item on the board.
+type Item struct {
+	Config *ItemConfig
+	X      int
+	Y      int
+	// Expire is the tick when the item disappears. 0 means never.
+	Expire int
+}
+
+// Effect is an effect of an item which is active on a player.
+type Effect struct {
+	Kind   string
+	Amount int
+	// Expire is the tick when the effect ends
+	Expire int
+}
+
+// spawnItems spawns each kind of item at its rate.
+func (game *Game) spawnItems() {
+	for i := range game.config.Items {
+		ic := &game.config.Items[i]
+		if game.board.rng.Float64() >= ic.Rate {
+			continue
+		}
+		x, y, ok := game.board.RandomEmptyCell()
+		if !ok {
+			return
+		}
+
+		item := &Item{Config: ic, X: x, Y: y}
+		if ic.Lifetime > 0 {
+			item.Expire = game.tick + ic.Lifetime
+		}
+		game.board.SetCell(x, y, itemCells[ic.Kind])
+		game.items = append(game.items, item)
+	}
+}
+
+// expireItems removes items whose lifetime is over.
+func (game *Game) expireItems() {
+	items := game.items[:0]
+	for _, item := range game.items {
+		if item.Expire > 0 && item.Expire <= game.tick {
+			if game.board.GetCell(item.X, item.Y) == itemCells[item.Config.Kind] {
+				game.board.SetCell(item.X, item.Y, api.CellEmpty)
+			}
+			continue
+		}
+		items = append(items, item)
+	}
+	game.items = items
+}
+
+// pickItem applies the item at (x, y) to the player and removes it from the board.
+// It returns false if there is no item.
+func (game *Game) pickItem(p *Player, x, y int) bool {
+	for i, item := range game.items {
+		if item.X != x || item.Y != y {
+			continue
+		}
+		game.items = append(game.items[:i], game.items[i+1:]...)
+		game.board.SetCell(x, y, api.CellEmpty)
+
+		ic := item.Config
+		log.Printf("%s picks %s", p.ID(), ic.Kind)
+		switch ic.Kind {
+		case ItemGrow:
+			p.size += ic.Amount
+		case ItemShrink:
+			n := ic.Amount
+			if p.size-n < 1 {
+				n = p.size - 1
+			}
+			p.size -= n
+			game.board.ShrinkBody(p.index, n)
+		default:
+			p.AddEffect(Effect{Kind: ic.Kind, Amount: ic.Amount, Expire: game.tick + ic.Duration})
+		}
+		return true
+	}
+	return false
+}
+
+func (p *Player) AddEffect(e Effect) {
+	if p.effects == nil {
+		p.effects = make(map[string]Effect)
+	}
+	p.effects[e.Kind] = e
+}
+
+// HasEffect reports whether the effect is active at the tick.
+func (p *Player) HasEffect(kind string, tick int) bool {
+	e, ok := p.effects[kind]
+	return ok && tick < e.Expire
+}
+
+// Multiplier returns the factor of the score at the tick.
+func (p *Player) Multiplier(tick int) int {
+	if !p.HasEffect(ItemMultiplier, tick) {
+		return 1
+	}
+	return p.effects[ItemMultiplier].Amount
+}
+
+// EffectsProtocol returns the active effects at the tick ordered by kind.
+func (p *Player) EffectsProtocol(tick int) []api.EffectResponse {
+	kinds := make([]string, 0, len(p.effects))
+	for kind := range p.effects {
+		if p.HasEffect(kind, tick) {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+
+	ret := make([]api.EffectResponse, len(kinds))
+	for i, kind := range kinds {
+		ret[i] = api.EffectResponse{
+			Kind:      kind,
+			Remaining: p.effects[kind].Expire - tick,
+		}
+	}
+	return ret
+}
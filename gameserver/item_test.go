@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/myoan/snake/api"
+)
+
+func putItem(game *Game, ic *ItemConfig, x, y int) {
+	game.board.SetCell(x, y, itemCells[ic.Kind])
+	game.items = append(game.items, &Item{Config: ic, X: x, Y: y})
+}
+
+func TestGame_Step_Shrink(t *testing.T) {
+	cfg := DefaultGameConfig()
+	cfg.InitSize = 5
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	putSnake(game, 1, 20, 20, api.MoveRight)
+	game.board.SetBody(9, 10, 4, 0)
+	game.board.SetBody(8, 10, 3, 0)
+	putItem(game, &ItemConfig{Kind: ItemShrink, Amount: 2}, 11, 10)
+
+	game.step()
+
+	if game.players[0].size != 3 {
+		t.Errorf("size: expected 3, but got %d", game.players[0].size)
+	}
+	if len(game.board.Bodies()[0]) != 3 {
+		t.Errorf("body: expected 3 cells, but got %v", game.board.Bodies()[0])
+	}
+	if len(game.items) != 0 {
+		t.Errorf("item should be picked")
+	}
+}
+
+func TestGame_Step_Ghost(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	putSnake(game, 1, 20, 20, api.MoveRight)
+	game.board.SetBody(11, 10, 2, 1)
+	game.players[0].AddEffect(Effect{Kind: ItemGhost, Expire: 5})
+
+	game.step()
+
+	if game.players[0].State != 0 {
+		t.Errorf("ghost should pass through the body")
+	}
+	if game.board.GetOwner(11, 10) != 1 {
+		t.Errorf("ghost should not overwrite the body")
+	}
+}
+
+func TestGame_Step_Ghost_Cross(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	// player 1 goes up across the way of the ghost
+	putSnake(game, 1, 11, 9, api.MoveUp)
+	game.board.SetBody(11, 10, 2, 1)
+	game.board.SetBody(11, 11, 1, 1)
+	game.players[0].AddEffect(Effect{Kind: ItemGhost, Expire: 5})
+
+	game.step()
+
+	crossed := []api.Point{{X: 11, Y: 8}, {X: 11, Y: 9}, {X: 11, Y: 10}}
+	if bodies := game.board.Bodies(); !reflect.DeepEqual(bodies[1], crossed) {
+		t.Errorf("crossed snake: expected %v, but got %v", crossed, bodies[1])
+	}
+
+	game.step()
+
+	// the cell of the ghost surfaces after the crossed snake leaves it
+	ghost := []api.Point{{X: 12, Y: 10}, {X: 11, Y: 10}, {X: 10, Y: 10}}
+	if bodies := game.board.Bodies(); !reflect.DeepEqual(bodies[0], ghost) {
+		t.Errorf("ghost: expected %v, but got %v", ghost, bodies[0])
+	}
+	if game.board.GetOwner(11, 10) != 0 {
+		t.Errorf("ghost should leave no gap in its body")
+	}
+}
+
+func TestGame_Step_Speed(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	putSnake(game, 1, 20, 20, api.MoveRight)
+	game.players[0].AddEffect(Effect{Kind: ItemSpeed, Expire: 5})
+
+	game.step()
+
+	if game.players[0].x != 12 {
+		t.Errorf("head: expected x 12, but got %d", game.players[0].x)
+	}
+	if game.players[1].x != 21 {
+		t.Errorf("head: expected x 21, but got %d", game.players[1].x)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -13,17 +12,15 @@ import (
 	"github.com/myoan/snake/api"
 )
 
-const (
-	Width     = 40
-	Height    = 40
-	InitSize  = 3
-	PlayerNum = 2
-)
-
 const (
 	EventClientConnect = iota
 	EventClientFinish
 	EventClientRestart
+	EventClientSpectate
+	// EventClientInput is a request from the client, such as a turn
+	EventClientInput
+	// EventClientResume is notified when the client resumed with a new connection
+	EventClientResume
 )
 
 type Observer interface {
@@ -33,9 +30,11 @@ type Observer interface {
 type TriggerArgument struct {
 	EventType int
 	Client    Client
+	// Message is the request of EventClientInput and EventClientRestart
+	Message []byte
 }
 
-func ingameHandler(mng *SceneManager, w http.ResponseWriter, r *http.Request) {
+func ingameHandler(ge *GameEngine, w http.ResponseWriter, r *http.Request) {
 	upgrader := websocket.Upgrader{}
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 	c, err := upgrader.Upgrade(w, r, nil)
@@ -44,19 +43,62 @@ func ingameHandler(mng *SceneManager, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stream := make(chan []byte)
-	obs := make([]Observer, 0)
-	client := &WebClient{
-		uuid:      uuid.NewString(),
-		stream:    stream,
-		conn:      c,
-		observers: obs,
+	hello, codec, err := handshake(c, ge.config)
+	if err != nil {
+		log.Printf("handshake: %v", err)
+		return
+	}
+	log.Printf("Hello from %s (version %d)", hello.Client, hello.Version)
+
+	opts := ClientOptions{
+		Delta:    hello.Delta,
+		Encoding: api.ChooseEncoding(hello.Encodings),
+	}
+	if hello.Resume != "" {
+		err = ge.Resume(hello.Resume, opts, c)
+		if err != nil {
+			log.Printf("resume: %v", err)
+			writeFrame(c, codec, &api.EventResponse{
+				Status: api.GameStatusError,
+				Error:  fmt.Sprintf("resume: %v", err),
+			})
+			c.Close()
+		}
+		return
+	}
+
+	token := ""
+	if ge.config.ResumeGrace > 0 {
+		token = uuid.NewString()
 	}
+	client := NewWebClient(uuid.NewString(), c, token, ge.config.ResumeWait(), opts)
 
 	log.Printf("Connect new websocket")
-	go client.Run(stream)
-	client.AddObserver(mng)
-	client.Notify(EventClientConnect)
+	go client.Run(client.Stream())
+	rr := RoomRequest{
+		Name: r.URL.Query().Get(api.QueryRoom),
+		Code: r.URL.Query().Get(api.QueryCode),
+	}
+	err = ge.Join(client, hello.Spectate, rr)
+	if err != nil {
+		log.Printf("join: %v", err)
+		data := &api.EventResponse{
+			Status: api.GameStatusError,
+			Error:  fmt.Sprintf("join: %v", err),
+		}
+
+		sendFrame(client, data)
+		client.Close()
+	}
+}
+
+// writeFrame sends the frame to the connection which has no client yet.
+func writeFrame(c *websocket.Conn, codec api.Codec, v interface{}) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(messageType(codec), data)
 }
 
 // doSignal shutsdown on SIGTERM/SIGKILL
@@ -71,19 +113,48 @@ func doSignal() {
 
 func main() {
 	var (
-		addr    string
-		agoness bool
+		addr       string
+		agoness    bool
+		maxRooms   int
+		configPath string
+		replayDir  string
+		replayPath string
+		flagCfg    GameConfig
 	)
 
 	flag.StringVar(&addr, "addr", ":8082", "http service address")
 	flag.BoolVar(&agoness, "agoness", false, "use Agoness framework")
+	flag.IntVar(&maxRooms, "rooms", 16, "max number of rooms hosted at the same time")
+	flag.StringVar(&configPath, "config", "", "match rules file (.json, .yaml)")
+	flag.StringVar(&replayDir, "replay-dir", "", "directory to record replays of matches (disabled if empty)")
+	flag.StringVar(&replayPath, "replay", "", "play the replay file instead of hosting matches")
+	flagCfg.RegisterFlags(flag.CommandLine)
 	flag.Parse()
+	log.Printf("gameserver %s (commit %s, protocol %d)", version, commit, api.ProtocolVersion)
+
+	if replayPath != "" {
+		replay, err := LoadReplayFile(replayPath)
+		if err != nil {
+			log.Fatalf("Failed to load replay: %v", err)
+		}
+		log.Printf("Play replay %s (seed: %d, players: %v)", replayPath, replay.Meta.Seed, replay.Meta.Players)
+		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			replayHandler(replay, w, r)
+		})
+		log.Fatal(http.ListenAndServe(addr, nil))
+	}
+
+	cfg, err := LoadGameConfig(configPath, flag.CommandLine, &flagCfg)
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	log.Printf("Config: %+v", *cfg)
 
 	var fw IGameServerFrameWork
-	var err error
 
 	if agoness {
-		ctx, _ := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 		fw, err = NewAgonessFrameWork(ctx, 4)
 		if err != nil {
 			log.Fatalf("Could not connect to sdk: %v", err)
@@ -97,58 +168,10 @@ func main() {
 		log.Fatalf("Agones SDK: Failed to Ready: %v", e)
 	}
 
-	ge := NewGameEngine()
-	ge.SceneMng.AddHandler(EventClientConnect, SceneMatchmaking, func(args interface{}) {
-		log.Printf("Scene: MatchMaking (%d)\n", len(ge.Clients))
-		ta := args.(TriggerArgument)
-		ge.AddClient(ta.Client)
-		ta.Client.Send([]byte(fmt.Sprintf("{\"status\":%d, \"id\": \"%s\"}", api.GameStatusInit, ta.Client.ID())))
-		if ge.ReachMaxClient() {
-			ge.SceneMng.MoveScene(SceneIngame)
-
-			err = fw.Allocate()
-			if err != nil {
-				log.Fatalf("Agones SDK: Failed to Allocate: %v", err)
-			}
-
-			ge.ExecuteIngame()
-		} else {
-			data := &api.EventResponse{
-				Status: api.GameStatusWaiting,
-			}
-
-			bytes, _ := json.Marshal(&data)
-			ta.Client.Send(bytes)
-		}
-	})
-
-	ge.SceneMng.AddHandler(EventClientConnect, SceneIngame, func(args interface{}) {
-		log.Printf("Scene: Ingame, ignore\n")
-		ta := args.(TriggerArgument)
-		ge.DeleteClient(ta.Client.ID())
-
-		data := &api.EventResponse{
-			Status: api.GameStatusError,
-		}
-
-		bytes, _ := json.Marshal(&data)
-		ta.Client.Send(bytes)
-	})
-
-	ge.SceneMng.AddHandler(EventClientFinish, SceneIngame, func(args interface{}) {
-		log.Printf("Trigger: EventClientFinish\n")
-		ta := args.(TriggerArgument)
-		ge.DeleteClient(ta.Client.ID())
-		if ge.Ingame.isFinish() {
-			err = fw.Shutdown()
-			if err != nil {
-				log.Fatalf("Agones SDK: Failed to Shutdown: %v", err)
-			}
-		}
-	})
+	ge := NewGameEngine(cfg, fw, maxRooms, replayDir)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		ingameHandler(ge.SceneMng, w, r)
+		ingameHandler(ge, w, r)
 	})
 	log.Fatal(http.ListenAndServe(addr, nil))
 }
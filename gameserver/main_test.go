@@ -0,0 +1,470 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/myoan/snake/api"
+)
+
+// testClient plays a match through the websocket until it finishes.
+type testClient struct {
+	conn    *websocket.Conn
+	codec   api.Codec
+	init    api.InitResponse
+	waiting []api.WaitingBody
+	frames  int
+	result  *api.ResultResponse
+	err     string
+}
+
+// dialTestClient connects and exchanges the hello and the welcome.
+func dialTestClient(t *testing.T, url string, hello api.Hello) *testClient {
+	t.Helper()
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello.Version = api.ProtocolVersion
+	c.WriteJSON(&hello)
+
+	var welcome api.Welcome
+	err = c.ReadJSON(&welcome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if welcome.Status != api.GameStatusWelcome {
+		t.Fatalf("expected welcome, but got status %d", welcome.Status)
+	}
+	codec, err := api.NewCodec(welcome.Encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{conn: c, codec: codec}
+}
+
+// play reads frames and turns at random. It stops after quit frames if quit is positive.
+func (c *testClient) play(rng *rand.Rand, quit int) {
+	defer c.conn.Close()
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		status, _ := c.codec.Status(msg)
+
+		switch status {
+		case api.GameStatusInit:
+			c.codec.Unmarshal(msg, &c.init)
+		case api.GameStatusWaiting:
+			var resp api.WaitingResponse
+			c.codec.Unmarshal(msg, &resp)
+			c.waiting = append(c.waiting, resp.Body)
+		case api.GameStatusOK, api.GameStatusDelta:
+			c.frames++
+			if quit > 0 && c.frames >= quit {
+				return
+			}
+			req := api.EventRequest{Eventtype: api.EventTypeMove, Key: rng.Intn(4)}
+			bytes, _ := c.codec.Marshal(&req)
+			c.conn.WriteMessage(messageType(c.codec), bytes)
+		case api.GameStatusFinished:
+			c.result = &api.ResultResponse{}
+			c.codec.Unmarshal(msg, c.result)
+			return
+		case api.GameStatusError:
+			var resp api.EventResponse
+			c.codec.Unmarshal(msg, &resp)
+			c.err = resp.Error
+			return
+		}
+	}
+}
+
+func TestGameEngine_Matches(t *testing.T) {
+	cfg := DefaultGameConfig()
+	cfg.Width = 20
+	cfg.Height = 20
+	cfg.TickInterval = 10
+	cfg.Topology = api.TopologyTorus
+	cfg.WinCondition = api.WinTimeLimit
+	cfg.TimeLimit = 1
+	cfg.RematchTimeout = 0
+	cfg.ResumeGrace = 0
+	fw, _ := NewNopFrameWork()
+	ge := NewGameEngine(cfg, fw, 4, "")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ingameHandler(ge, w, r)
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	var wg sync.WaitGroup
+	players := make([]*testClient, 4)
+	for i := range players {
+		// players with odd indices use the binary encoding
+		hello := api.Hello{Encodings: []string{api.EncodingJSON}}
+		if i%2 == 1 {
+			hello.Encodings = []string{"unknown", api.EncodingBinary}
+		}
+		players[i] = dialTestClient(t, url, hello)
+		quit := 0
+		if i == 0 {
+			// leaves in the middle of the match
+			quit = 10
+		}
+		wg.Add(1)
+		go func(c *testClient, seed int64) {
+			defer wg.Done()
+			c.play(rand.New(rand.NewSource(seed)), quit)
+		}(players[i], int64(i))
+	}
+
+	// wait for matches to start, then watch one of them
+	time.Sleep(200 * time.Millisecond)
+	spectator := dialTestClient(t, url, api.Hello{
+		Encodings: []string{api.EncodingBinary},
+		Delta:     true,
+		Spectate:  true,
+	})
+	spectator.play(rand.New(rand.NewSource(9)), 0)
+	wg.Wait()
+
+	if !spectator.init.Spectator {
+		t.Errorf("spectator: init should be for a spectator")
+	}
+	if spectator.result == nil {
+		t.Errorf("spectator: result not received")
+	}
+	for i, c := range players[1:] {
+		if c.init.ID == "" {
+			t.Errorf("player %d: init not received", i+1)
+		}
+		if c.init.Config.Width != cfg.Width {
+			t.Errorf("player %d: expected width %d, but got %d", i+1, cfg.Width, c.init.Config.Width)
+		}
+		if c.result == nil {
+			t.Errorf("player %d: result not received", i+1)
+			continue
+		}
+		if len(c.result.Body.Standings) != cfg.PlayerNum {
+			t.Errorf("player %d: expected %d standings, but got %d", i+1, cfg.PlayerNum, len(c.result.Body.Standings))
+		}
+	}
+
+	// rooms are deleted after their matches
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		ge.mu.Lock()
+		n := len(ge.Rooms)
+		ge.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rooms: expected 0, but got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGameEngine_Handshake(t *testing.T) {
+	cfg := DefaultGameConfig()
+	fw, _ := NewNopFrameWork()
+	ge := NewGameEngine(cfg, fw, 4, "")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ingameHandler(ge, w, r)
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	hellos := []api.Hello{
+		{Version: api.ProtocolVersion + 1},
+		{Version: api.ProtocolVersion, Encodings: []string{"xml"}},
+		{Version: api.ProtocolVersion, Resume: "unknown"},
+	}
+	for _, hello := range hellos {
+		c, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.WriteJSON(&hello)
+
+		// a resuming client is welcomed before the session is checked
+		var resp api.EventResponse
+		for {
+			err = c.ReadJSON(&resp)
+			if err != nil {
+				t.Fatalf("%+v: %v", hello, err)
+			}
+			if resp.Status != api.GameStatusWelcome {
+				break
+			}
+		}
+		if resp.Status != api.GameStatusError || resp.Error == "" {
+			t.Errorf("%+v: expected an error frame with the reason, but got %+v", hello, resp)
+		}
+		c.Close()
+	}
+}
+
+func TestGameEngine_Countdown(t *testing.T) {
+	cfg := DefaultGameConfig()
+	cfg.Width = 20
+	cfg.Height = 20
+	cfg.PlayerNum = 3
+	cfg.MinPlayers = 2
+	cfg.Countdown = 1
+	cfg.TickInterval = 10
+	cfg.Topology = api.TopologyTorus
+	cfg.WinCondition = api.WinTimeLimit
+	cfg.TimeLimit = 1
+	cfg.RematchTimeout = 0
+	cfg.ResumeGrace = 0
+	cfg.BotWait = 0
+	fw, _ := NewNopFrameWork()
+	ge := NewGameEngine(cfg, fw, 1, "")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ingameHandler(ge, w, r)
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	var wg sync.WaitGroup
+	players := make([]*testClient, 2)
+	for i := range players {
+		players[i] = dialTestClient(t, url, api.Hello{Encodings: []string{api.EncodingBinary}})
+		wg.Add(1)
+		go func(c *testClient, seed int64) {
+			defer wg.Done()
+			c.play(rand.New(rand.NewSource(seed)), 0)
+		}(players[i], int64(i))
+		// the first player waits alone
+		time.Sleep(50 * time.Millisecond)
+	}
+	wg.Wait()
+
+	first := players[0]
+	if len(first.waiting) < 2 {
+		t.Fatalf("expected waiting frames before and after the second player, but got %+v", first.waiting)
+	}
+	alone := api.WaitingBody{Players: 1, Needed: 1, MaxPlayers: 3}
+	if first.waiting[0] != alone {
+		t.Errorf("expected %+v, but got %+v", alone, first.waiting[0])
+	}
+	countdown := api.WaitingBody{Players: 2, MaxPlayers: 3, SecondsLeft: 1}
+	if first.waiting[1] != countdown {
+		t.Errorf("expected %+v, but got %+v", countdown, first.waiting[1])
+	}
+	for i, c := range players {
+		if c.result == nil {
+			t.Errorf("player %d: result not received", i)
+			continue
+		}
+		if len(c.result.Body.Standings) != 2 {
+			t.Errorf("player %d: expected 2 standings, but got %d", i, len(c.result.Body.Standings))
+		}
+	}
+}
+
+func TestGameEngine_NamedRooms(t *testing.T) {
+	cfg := DefaultGameConfig()
+	cfg.Width = 20
+	cfg.Height = 20
+	cfg.PlayerNum = 2
+	cfg.TickInterval = 10
+	cfg.Topology = api.TopologyTorus
+	cfg.WinCondition = api.WinTimeLimit
+	cfg.TimeLimit = 1
+	cfg.RematchTimeout = 0
+	cfg.ResumeGrace = 0
+	cfg.BotWait = 0
+	fw, _ := NewNopFrameWork()
+	ge := NewGameEngine(cfg, fw, 2, "")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ingameHandler(ge, w, r)
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	private := url + "?room=friends&code=secret"
+
+	var wg sync.WaitGroup
+	play := func(c *testClient, seed int64) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.play(rand.New(rand.NewSource(seed)), 0)
+		}()
+	}
+
+	owner := dialTestClient(t, private, api.Hello{})
+	play(owner, 1)
+	time.Sleep(50 * time.Millisecond)
+
+	intruder := dialTestClient(t, url+"?room=friends&code=guess", api.Hello{})
+	intruder.play(rand.New(rand.NewSource(2)), 0)
+	if !strings.Contains(intruder.err, "wrong join code") {
+		t.Errorf("expected the wrong join code error, but got %q", intruder.err)
+	}
+
+	// a public client does not fill the named room
+	stranger := dialTestClient(t, url, api.Hello{})
+	play(stranger, 3)
+	time.Sleep(50 * time.Millisecond)
+	ge.mu.Lock()
+	rooms := len(ge.Rooms)
+	ge.mu.Unlock()
+	if rooms != 2 {
+		t.Errorf("rooms: expected 2, but got %d", rooms)
+	}
+
+	friend := dialTestClient(t, private, api.Hello{})
+	play(friend, 4)
+	time.Sleep(50 * time.Millisecond)
+	stranger.conn.Close()
+	wg.Wait()
+
+	for name, c := range map[string]*testClient{"owner": owner, "friend": friend} {
+		if c.result == nil {
+			t.Errorf("%s: result not received", name)
+			continue
+		}
+		if len(c.result.Body.Standings) != 2 {
+			t.Errorf("%s: expected 2 standings, but got %d", name, len(c.result.Body.Standings))
+		}
+	}
+	if stranger.result != nil {
+		t.Errorf("stranger: expected to wait alone, but got a result")
+	}
+}
+
+// lateClient keeps the frames sent to it and reports when it is closed.
+type lateClient struct {
+	DummyClient
+	frames [][]byte
+	closed chan struct{}
+}
+
+func newLateClient(id string) *lateClient {
+	return &lateClient{DummyClient: *NewDummyClient(id), closed: make(chan struct{})}
+}
+
+func (c *lateClient) Send(data []byte) error { c.frames = append(c.frames, data); return nil }
+func (c *lateClient) Close()                 { close(c.closed) }
+
+// TestRoom_LateConnect finishes a match while a client is on the way to the room.
+func TestRoom_LateConnect(t *testing.T) {
+	// the room waits for a rematch, or is deleted at once
+	for _, timeout := range []int{15, 0} {
+		cfg := DefaultGameConfig()
+		cfg.PlayerNum = 1
+		cfg.RematchTimeout = timeout
+		fw, _ := NewNopFrameWork()
+		ge := NewGameEngine(cfg, fw, 1, "")
+		room := NewRoom(cfg)
+		ge.setupRoom(room)
+		ge.Rooms = append(ge.Rooms, room)
+
+		// the room is driven by the test instead of its goroutine
+		player := newLateClient("player")
+		room.reserve()
+		room.handle(TriggerArgument{EventType: EventClientConnect, Client: player})
+		late := newLateClient("late")
+		room.reserve()
+		ge.finishRoom(room)
+		if room.deleted {
+			t.Errorf("timeout %d: room is stopped before the late client arrives", timeout)
+		}
+		room.handle(TriggerArgument{EventType: EventClientConnect, Client: late})
+
+		select {
+		case <-late.closed:
+		case <-time.After(time.Second):
+			t.Fatalf("timeout %d: late client is not closed", timeout)
+		}
+		if len(late.frames) != 1 {
+			t.Fatalf("timeout %d: expected an error frame, but got %d frames", timeout, len(late.frames))
+		}
+		var resp api.EventResponse
+		api.JSONCodec{}.Unmarshal(late.frames[0], &resp)
+		if resp.Status != api.GameStatusError || resp.Error == "" {
+			t.Errorf("timeout %d: expected an error frame with the reason, but got %+v", timeout, resp)
+		}
+
+		deleted := timeout == 0
+		if room.deleted != deleted || (len(ge.Rooms) == 0) != deleted {
+			t.Errorf("timeout %d: expected deleted=%v, but got %v with %d rooms", timeout, deleted, room.deleted, len(ge.Rooms))
+		}
+		if !deleted && len(room.Clients) != 1 {
+			t.Errorf("timeout %d: expected the player to wait for a rematch alone, but got %d clients", timeout, len(room.Clients))
+		}
+		close(room.done)
+	}
+}
+
+func TestGameEngine_Resume_Options(t *testing.T) {
+	cfg := DefaultGameConfig()
+	fw, _ := NewNopFrameWork()
+	ge := NewGameEngine(cfg, fw, 1, "")
+	opts := ClientOptions{Encoding: api.EncodingJSON}
+	ge.sessions["token"] = &session{client: NewWebClient("a", nil, "token", time.Second, opts)}
+
+	for _, o := range []ClientOptions{
+		{Encoding: api.EncodingBinary},
+		{Encoding: api.EncodingJSON, Delta: true},
+	} {
+		err := ge.Resume("token", o, nil)
+		if err == nil || !strings.Contains(err.Error(), "differ") {
+			t.Errorf("%+v: expected the options to be rejected, but got %v", o, err)
+		}
+	}
+}
+
+// annotateFrameWork keeps the annotations, and fails to take ge.mu if it is held during the SDK call.
+type annotateFrameWork struct {
+	NopFrameWork
+	ge     *GameEngine
+	values []string
+}
+
+func (fw *annotateFrameWork) SetAnnotation(key, value string) error {
+	fw.ge.mu.Lock()
+	defer fw.ge.mu.Unlock()
+	fw.values = append(fw.values, value)
+	return nil
+}
+
+func TestGameEngine_AnnotateRooms(t *testing.T) {
+	cfg := DefaultGameConfig()
+	fw := &annotateFrameWork{}
+	ge := NewGameEngine(cfg, fw, 2, "")
+	fw.ge = ge
+
+	routed := make(chan error)
+	go func() {
+		_, err := ge.route(false, RoomRequest{Name: "friends"})
+		routed <- err
+	}()
+	select {
+	case err := <-routed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("rooms are annotated with ge.mu held")
+	}
+	if len(fw.values) != 1 || fw.values[0] != "friends" {
+		t.Errorf("expected the annotation 'friends', but got %v", fw.values)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "expvar"
+
+// Metrics of the server, which are published at /debug/vars.
+var (
+	// metricSendQueued is the number of frames waiting in the send queues of every client
+	metricSendQueued = expvar.NewInt("send_queued")
+	// metricSendQueuePeak is the deepest send queue of a client so far
+	metricSendQueuePeak = expvar.NewInt("send_queue_peak")
+	// metricEvictions is the number of clients evicted because their send queue was full
+	metricEvictions   = expvar.NewInt("slow_client_evictions")
+	metricWriteErrors = expvar.NewInt("write_errors")
+	// metricPongTimeouts is the number of connections dropped because the client stopped answering pings
+	metricPongTimeouts = expvar.NewInt("pong_timeouts")
+)
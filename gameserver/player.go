@@ -1,53 +1,58 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
+	"time"
 
 	"github.com/myoan/snake/api"
 )
 
+// inputQueueSize is the number of turns a player can queue ahead of ticks.
+const inputQueueSize = 4
+
 type Player struct {
+	// index is the position in the players of the game, which is used as the owner of the board
+	index     int
 	size      int
 	x         int
 	y         int
 	direction int
 	Client    Client
-	done      chan struct{}
-	State     int
+	// inputs are turns requested by the client, consumed one per tick by the game
+	inputs chan int
+	State  int
+	// killedBy is the ID of the player whose snake killed this snake
+	killedBy string
+	score    int
+	effects  map[string]Effect
+	kills    int
+	// diedAt is the tick when the snake died
+	diedAt int
+	// team is the ID of the team assigned at the start of the match, or 0 if the match has no teams
+	team int
 }
 
 func (p *Player) ID() string {
 	return p.Client.ID()
 }
-func NewPlayer(client Client, stream <-chan []byte, w, h int) *Player {
-	done := make(chan struct{})
-	x := rand.Intn(w)
-	y := rand.Intn(h)
-	d := rand.Intn(4)
-
-	p := &Player{
-		size:      InitSize,
-		x:         x,
-		y:         y,
-		direction: d,
-		Client:    client,
-		done:      done,
-		State:     0,
+func NewPlayer(client Client, cfg *GameConfig) *Player {
+	return &Player{
+		size:   cfg.InitSize,
+		Client: client,
+		inputs: make(chan int, inputQueueSize),
+		State:  0,
 	}
-	go p.run(stream)
-	return p
 }
 
-func (p *Player) Finish() {
+// Die marks the snake dead at the tick. The player keeps watching the match until it finishes.
+func (p *Player) Die(tick int) {
 	p.State = 1
-	p.done <- struct{}{}
-	p.Client.Close()
+	p.diedAt = tick
 }
 
-func (p *Player) Send(status int, board *Board, players []*Player) error {
+func NewEventResponse(status, tick int, board *Board, players []*Player) *api.EventResponse {
+	bodies := board.Bodies()
 	playersProtocol := make([]api.PlayerResponse, len(players))
 	for i, player := range players {
 		playersProtocol[i] = api.PlayerResponse{
@@ -56,26 +61,60 @@ func (p *Player) Send(status int, board *Board, players []*Player) error {
 			Y:         player.y,
 			Size:      player.size,
 			Direction: player.direction,
+			Body:      bodies[player.index],
+			KilledBy:  player.killedBy,
+			Score:     player.score,
+			Effects:   player.EffectsProtocol(tick),
+			Dead:      player.State == 1,
+			Latency:   int(player.Client.Latency() / time.Millisecond),
+			Team:      player.team,
 		}
 	}
 
-	resp := &api.EventResponse{
+	return &api.EventResponse{
 		Status: status,
 		Body: api.ResponseBody{
+			Tick:    tick,
 			Board:   board.ToArray(),
 			Width:   board.width,
 			Height:  board.height,
 			Players: playersProtocol,
 		},
 	}
+}
 
-	bytes, _ := json.Marshal(&resp)
-	return p.Client.Send(bytes)
+// Spawn puts the snake at random empty cell and direction drawn from the board's RNG.
+// It returns error if the board has no empty cell.
+func (p *Player) Spawn(board *Board) error {
+	x, y, ok := board.randomCell()
+	if !ok {
+		return fmt.Errorf("no empty cell to spawn %s", p.ID())
+	}
+	p.x = x
+	p.y = y
+	p.direction = board.rng.Intn(4)
+	p.GenerateSnake(board)
+	return nil
 }
 
-func (p *Player) GenerateSnake(board *Board) {
-	log.Printf("GenerateSnake(%d, %d)", p.x, p.y)
+// SpawnAt puts the snake at the spawn point of the map.
+// It returns error if the spawn point is not an empty cell of the board.
+func (p *Player) SpawnAt(board *Board, s Spawn) error {
+	if !board.Contains(s.X, s.Y) || board.GetCell(s.X, s.Y) != api.CellEmpty {
+		return fmt.Errorf("spawn (%d, %d) of %s is not empty", s.X, s.Y, p.ID())
+	}
+	p.x = s.X
+	p.y = s.Y
+	if s.Direction != nil {
+		p.direction = *s.Direction
+	} else {
+		p.direction = board.rng.Intn(4)
+	}
+	p.GenerateSnake(board)
+	return nil
+}
 
+func (p *Player) GenerateSnake(board *Board) {
 	var dx, dy int
 	switch p.direction {
 	case api.MoveUp:
@@ -96,21 +135,37 @@ func (p *Player) GenerateSnake(board *Board) {
 	y := p.y
 
 	for i := p.size; i >= 0; i-- {
-		board.SetCell(x, y, i)
-		if x+dx < 0 || x+dx >= board.width {
-			dx = 0
-			dy = 1
+		// the body does not overwrite walls and other snakes
+		if i < p.size && board.GetCell(x, y) != api.CellEmpty {
+			break
 		}
-		if y+dy < 0 || y+dy >= board.height {
-			dx = 1
-			dy = 0
+		board.SetBody(x, y, i, p.index)
+		if !board.torus {
+			// bend the body at walls
+			if x+dx < 0 || x+dx >= board.width {
+				dx = 0
+				dy = 1
+			}
+			if y+dy < 0 || y+dy >= board.height {
+				dx = 1
+				dy = 0
+			}
+			// the corner on the right turns up, or left at the top
+			if !board.Contains(x+dx, y+dy) {
+				dx = 0
+				dy = -1
+			}
+			if !board.Contains(x+dx, y+dy) {
+				dx = -1
+				dy = 0
+			}
 		}
-		x += dx
-		y += dy
+		x, y, _ = board.Wrap(x+dx, y+dy)
 	}
 }
 
-func (p *Player) Move(board *Board) error {
+// Next returns the cell which the head moves to in this tick.
+func (p *Player) Next() (int, int) {
 	var dx, dy int
 	switch p.direction {
 	case api.MoveLeft:
@@ -126,48 +181,56 @@ func (p *Player) Move(board *Board) error {
 		dx = 0
 		dy = 1
 	}
+	return p.x + dx, p.y + dy
+}
 
-	nextX := p.x + dx
-	nextY := p.y + dy
+// MoveTo moves the head to the cell which is already checked by the game.
+func (p *Player) MoveTo(board *Board, x, y int) {
+	board.SetBody(x, y, p.size, p.index)
+	p.x = x
+	p.y = y
+}
 
-	if nextX < 0 || nextX == board.width || nextY < 0 || nextY == board.height {
-		return fmt.Errorf("out of border")
-	}
-	if board.GetCell(nextX, nextY) > 0 {
-		return fmt.Errorf("stamp snake")
+// Kill records that the snake is killed by the snake of killer.
+// A snake can be killed by itself.
+func (p *Player) Kill(killer *Player) {
+	p.killedBy = killer.ID()
+	if killer != p {
+		killer.kills++
 	}
-	if board.HitApple(nextX, nextY) {
-		board.GenerateApple()
-		p.size++
-	}
-	board.SetCell(nextX, nextY, p.size+1)
-	p.x = nextX
-	p.y = nextY
-	return nil
+	log.Printf("%s is killed by %s", p.ID(), killer.ID())
 }
 
-func (p *Player) ChangeDirection(direction int) {
-	// log.Printf("change direction: %d -> %d", p.direction, direction)
-	// Do not turn around
-	if p.direction == api.MoveDown && direction == api.MoveUp ||
-		p.direction == api.MoveUp && direction == api.MoveDown ||
-		p.direction == api.MoveLeft && direction == api.MoveRight ||
-		p.direction == api.MoveRight && direction == api.MoveLeft {
-		return
+// Queue adds a turn requested by the client. The turn is dropped if the queue is full.
+func (p *Player) Queue(direction int) {
+	select {
+	case p.inputs <- direction:
+	default:
+		log.Printf("%s: input queue is full, drop %d", p.ID(), direction)
 	}
-	p.direction = direction
 }
 
-func (p *Player) run(stream <-chan []byte) {
+// NextTurn applies the first legal turn in the queue, which is called once a tick.
+// moved is the direction the snake moved in the last tick. Turns which go straight or turn
+// around from it are discarded, and turns after the applied one are left for later ticks.
+func (p *Player) NextTurn(moved int) {
 	for {
 		select {
-		case <-p.done:
+		case d := <-p.inputs:
+			if d < api.MoveLeft || d > api.MoveDown || d == moved || isReverse(moved, d) {
+				continue
+			}
+			p.direction = d
+			return
+		default:
 			return
-		case msg := <-stream:
-			var req api.EventRequest
-			json.Unmarshal(msg, &req)
-
-			p.ChangeDirection(req.Key)
 		}
 	}
 }
+
+func isReverse(from, to int) bool {
+	return from == api.MoveDown && to == api.MoveUp ||
+		from == api.MoveUp && to == api.MoveDown ||
+		from == api.MoveLeft && to == api.MoveRight ||
+		from == api.MoveRight && to == api.MoveLeft
+}
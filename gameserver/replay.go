@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/myoan/snake/api"
+)
+
+// A replay file is newline-delimited JSON of ReplayRecord.
+// It starts with a meta record, followed by turn records in tick order, and ends with an end record.
+const (
+	ReplayRecordMeta = "meta"
+	ReplayRecordTurn = "turn"
+	ReplayRecordEnd  = "end"
+)
+
+type ReplayRecord struct {
+	Type      string     `json:"type"`
+	Tick      int        `json:"tick,omitempty"`
+	Meta      *MatchMeta `json:"meta,omitempty"`
+	Player    string     `json:"player,omitempty"`
+	Direction int        `json:"direction,omitempty"`
+}
+
+// Recorder receives everything required to rebuild a match.
+type Recorder interface {
+	Start(meta MatchMeta)
+	// Turn is called when the player moves to a new direction at the tick
+	Turn(tick int, pid string, direction int)
+	Finish(tick int)
+}
+
+type NopRecorder struct{}
+
+func (r *NopRecorder) Start(meta MatchMeta)                     {}
+func (r *NopRecorder) Turn(tick int, pid string, direction int) {}
+func (r *NopRecorder) Finish(tick int)                          {}
+
+// FileRecorder writes the replay to a file as the match runs.
+type FileRecorder struct {
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewFileRecorder(path string) (*FileRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileRecorder{
+		file: f,
+		enc:  json.NewEncoder(f),
+	}, nil
+}
+
+func (r *FileRecorder) Start(meta MatchMeta) {
+	r.write(ReplayRecord{Type: ReplayRecordMeta, Meta: &meta})
+}
+
+func (r *FileRecorder) Turn(tick int, pid string, direction int) {
+	r.write(ReplayRecord{Type: ReplayRecordTurn, Tick: tick, Player: pid, Direction: direction})
+}
+
+func (r *FileRecorder) Finish(tick int) {
+	r.write(ReplayRecord{Type: ReplayRecordEnd, Tick: tick})
+	err := r.file.Close()
+	if err != nil {
+		log.Printf("[Error] close replay %s: %v", r.file.Name(), err)
+	}
+}
+
+func (r *FileRecorder) write(rec ReplayRecord) {
+	err := r.enc.Encode(&rec)
+	if err != nil {
+		log.Printf("[Error] write replay %s: %v", r.file.Name(), err)
+	}
+}
+
+// Replay is a recorded match loaded from a replay file.
+type Replay struct {
+	Meta  MatchMeta
+	End   int
+	turns map[int][]ReplayRecord
+}
+
+func LoadReplayFile(path string) (*Replay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadReplay(f)
+}
+
+func LoadReplay(r io.Reader) (*Replay, error) {
+	replay := &Replay{
+		turns: make(map[int][]ReplayRecord),
+	}
+
+	hasMeta := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var rec ReplayRecord
+		err := json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			return nil, fmt.Errorf("parse replay: %v", err)
+		}
+
+		switch rec.Type {
+		case ReplayRecordMeta:
+			if rec.Meta == nil {
+				return nil, fmt.Errorf("parse replay: meta record without meta")
+			}
+			replay.Meta = *rec.Meta
+			hasMeta = true
+		case ReplayRecordTurn:
+			replay.turns[rec.Tick] = append(replay.turns[rec.Tick], rec)
+		case ReplayRecordEnd:
+			replay.End = rec.Tick
+		default:
+			return nil, fmt.Errorf("parse replay: unknown record type '%s'", rec.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !hasMeta {
+		return nil, fmt.Errorf("parse replay: meta record not found")
+	}
+	return replay, nil
+}
+
+// replayClient is a client of a player in the replay.
+type replayClient struct {
+	id     string
+	stream chan []byte
+}
+
+func (c *replayClient) ID() string {
+	return c.id
+}
+
+func (c *replayClient) Token() string {
+	return ""
+}
+
+func (c *replayClient) Options() ClientOptions {
+	return ClientOptions{}
+}
+
+func (c *replayClient) Send(data []byte) error {
+	return nil
+}
+
+func (c *replayClient) Close() {}
+
+func (c *replayClient) Stream() chan []byte {
+	return c.stream
+}
+
+func (c *replayClient) Latency() time.Duration {
+	return 0
+}
+
+// Play rebuilds the match tick by tick.
+// fn is called after every tick, and playing stops if fn returns error.
+func (r *Replay) Play(fn func(game *Game) error) error {
+	cfg := r.Meta.Config
+	cfg.gameMap = r.Meta.Map
+	players := make([]*Player, len(r.Meta.Players))
+	for i, id := range r.Meta.Players {
+		c := &replayClient{
+			id:     id,
+			stream: make(chan []byte),
+		}
+		players[i] = NewPlayer(c, &cfg)
+	}
+	game := NewGame(&cfg, r.Meta.Seed, make(chan Event), players)
+
+	for {
+		for _, rec := range r.turns[game.tick+1] {
+			for _, p := range players {
+				if p.ID() == rec.Player {
+					p.direction = rec.Direction
+				}
+			}
+		}
+
+		finished := game.step()
+		err := fn(game)
+		if err != nil {
+			return err
+		}
+		if finished || (r.End > 0 && game.tick >= r.End) {
+			return nil
+		}
+	}
+}
+
+// replayHandler streams the replay to the client in the same frames as a live match.
+// The client can follow a player by the query parameter 'id'.
+func replayHandler(replay *Replay, w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Print("upgrade:", err)
+		return
+	}
+	defer c.Close()
+
+	_, codec, err := handshake(c, &replay.Meta.Config)
+	if err != nil {
+		log.Printf("handshake: %v", err)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		id = uuid.NewString()
+	}
+
+	resp := &api.InitResponse{
+		Status: api.GameStatusInit,
+		ID:     id,
+		Config: replay.Meta.Config.Protocol(),
+	}
+	err = writeFrame(c, codec, resp)
+	if err != nil {
+		log.Printf("[Error] write: %v", err)
+		return
+	}
+
+	t := time.NewTicker(replay.Meta.Config.Tick())
+	defer t.Stop()
+
+	var last *Game
+	err = replay.Play(func(game *Game) error {
+		<-t.C
+		last = game
+		// the snapshot is built by the tick already
+		data, err := codec.Marshal(game.last)
+		if err != nil {
+			return err
+		}
+		return c.WriteMessage(messageType(codec), codec.Envelope(data, id))
+	})
+	if err != nil {
+		log.Printf("[Error] replay: %v", err)
+		return
+	}
+
+	// tell the end of the replay in the same way as the end of a live match
+	if last != nil {
+		writeFrame(c, codec, last.Result())
+	}
+}
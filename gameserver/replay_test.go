@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/myoan/snake/api"
+)
+
+func TestReplay_Play(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newDummyGame(cfg, 7)
+
+	path := filepath.Join(t.TempDir(), "replay.ndjson")
+	rec, err := NewFileRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	game.SetRecorder(rec)
+	rec.Start(game.Meta())
+
+	dirs := []int{api.MoveUp, api.MoveLeft, api.MoveDown, api.MoveRight}
+	for i := 0; i < 30; i++ {
+		if i%5 == 0 {
+			// turns go through the queue like requests of clients
+			game.players[0].Queue(dirs[(i/5)%len(dirs)])
+		}
+		if game.step() {
+			break
+		}
+	}
+	rec.Finish(game.tick)
+
+	replay, err := LoadReplayFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay.Meta.Seed != 7 {
+		t.Errorf("seed: expected 7, but got %d", replay.Meta.Seed)
+	}
+	if len(replay.turns) == 0 {
+		t.Errorf("turns from the queue should be recorded")
+	}
+
+	var last *Game
+	err = replay.Play(func(g *Game) error {
+		last = g
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if last.tick != game.tick {
+		t.Errorf("tick: expected %d, but got %d", game.tick, last.tick)
+	}
+	if !reflect.DeepEqual(last.board.ToArray(), game.board.ToArray()) {
+		t.Errorf("replayed board differs from the recorded match")
+	}
+}
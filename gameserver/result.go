@@ -0,0 +1,175 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/myoan/snake/api"
+)
+
+// isOver reports whether the match reaches the end by the win condition.
+// Every condition finishes the match when no snake is alive.
+func (game *Game) isOver() bool {
+	alive := 0
+	longest := 0
+	for _, p := range game.players {
+		if p.State == 0 {
+			alive++
+			if p.size > longest {
+				longest = p.size
+			}
+		}
+	}
+	if alive == 0 {
+		return true
+	}
+
+	switch game.config.WinCondition {
+	case api.WinLength:
+		if game.config.Teams > 0 {
+			// teams are ranked by the combined length, so they race to it
+			return game.longestTeam() >= game.config.TargetLength
+		}
+		return longest >= game.config.TargetLength
+	case api.WinTimeLimit:
+		return game.tick >= game.config.TimeLimitTicks()
+	default:
+		// a solo match lasts until the snake dies
+		if game.config.Teams > 0 {
+			return len(game.players) > 1 && game.aliveTeams() <= 1
+		}
+		return len(game.players) > 1 && alive <= 1
+	}
+}
+
+// Result returns the final standings of the match.
+// In a team match, teams are ranked, and players share the rank of their team.
+func (game *Game) Result() *api.ResultResponse {
+	standings := make([]api.Standing, len(game.players))
+	for i, p := range game.players {
+		survival := game.tick
+		if p.State == 1 {
+			survival = p.diedAt
+		}
+		standings[i] = api.Standing{
+			ID:            p.ID(),
+			Length:        p.size,
+			Score:         p.score,
+			Kills:         p.kills,
+			SurvivalTicks: survival,
+			Alive:         p.State == 0,
+			Team:          p.team,
+		}
+	}
+
+	var teams []api.TeamStanding
+	if game.config.Teams > 0 {
+		teams = game.rankTeams(standings)
+	} else {
+		rankStandings(standings, game.rankLess(false))
+	}
+
+	return &api.ResultResponse{
+		Status: api.GameStatusFinished,
+		Body: api.ResultBody{
+			Tick:      game.tick,
+			Standings: standings,
+			Teams:     teams,
+		},
+	}
+}
+
+// rankStandings sorts standings by less and sets their ranks.
+func rankStandings(standings []api.Standing, less func(a, b *api.Standing) bool) {
+	sort.SliceStable(standings, func(i, j int) bool {
+		return less(&standings[i], &standings[j])
+	})
+	for i := range standings {
+		// players in a tie share the rank of the first of them
+		if i > 0 && !less(&standings[i-1], &standings[i]) {
+			standings[i].Rank = standings[i-1].Rank
+		} else {
+			standings[i].Rank = i + 1
+		}
+	}
+}
+
+// rankTeams ranks the teams of the standings, and sets the rank of each player to the rank of the team.
+// A team is ranked as a player whose length is the combined length and who survived as long as the last snake of the team.
+// Players are ordered by the rank of the team, and by their own standings in the team.
+func (game *Game) rankTeams(standings []api.Standing) []api.TeamStanding {
+	index := make(map[int]int)
+	var combined []api.Standing
+	for _, s := range standings {
+		i, ok := index[s.Team]
+		if !ok {
+			i = len(combined)
+			index[s.Team] = i
+			combined = append(combined, api.Standing{Team: s.Team})
+		}
+		t := &combined[i]
+		t.Length += s.Length
+		t.Alive = t.Alive || s.Alive
+		if s.SurvivalTicks > t.SurvivalTicks {
+			t.SurvivalTicks = s.SurvivalTicks
+		}
+	}
+	rankStandings(combined, game.rankLess(true))
+
+	ranks := make(map[int]int)
+	teams := make([]api.TeamStanding, len(combined))
+	for i, t := range combined {
+		ranks[t.Team] = t.Rank
+		teams[i] = api.TeamStanding{Team: t.Team, Rank: t.Rank, Length: t.Length, Alive: t.Alive}
+	}
+
+	less := game.rankLess(false)
+	sort.SliceStable(standings, func(i, j int) bool {
+		a, b := &standings[i], &standings[j]
+		if ranks[a.Team] != ranks[b.Team] {
+			return ranks[a.Team] < ranks[b.Team]
+		}
+		return less(a, b)
+	})
+	for i := range standings {
+		standings[i].Rank = ranks[standings[i].Team]
+	}
+	return teams
+}
+
+// rankLess returns the order of standings by the win condition.
+// Each condition compares keys in order, and the first different key decides.
+// Teams are ordered by the combined length unless the last team standing wins.
+func (game *Game) rankLess(teams bool) func(a, b *api.Standing) bool {
+	alive := func(s *api.Standing) int {
+		if s.Alive {
+			return 1
+		}
+		return 0
+	}
+	length := func(s *api.Standing) int { return s.Length }
+	survival := func(s *api.Standing) int { return s.SurvivalTicks }
+
+	var keys []func(s *api.Standing) int
+	switch game.config.WinCondition {
+	case api.WinLength:
+		keys = append(keys, length, alive, survival)
+	case api.WinTimeLimit:
+		if teams {
+			// the highest combined length wins, even if the team is wiped out
+			keys = append(keys, length, alive, survival)
+		} else {
+			keys = append(keys, alive, length, survival)
+		}
+	default:
+		keys = append(keys, alive, survival, length)
+	}
+
+	return func(a, b *api.Standing) bool {
+		for _, key := range keys {
+			if key(a) != key(b) {
+				return key(a) > key(b)
+			}
+		}
+		return false
+	}
+}
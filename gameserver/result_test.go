@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/myoan/snake/api"
+)
+
+func TestGame_Result_LastAlive(t *testing.T) {
+	cfg := DefaultGameConfig()
+	cfg.PlayerNum = 3
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	putSnake(game, 1, 20, 20, api.MoveRight)
+	putSnake(game, 2, 30, 30, api.MoveRight)
+	// player 0 runs into the body of player 1
+	game.board.SetBody(11, 10, 2, 1)
+
+	if game.step() {
+		t.Fatalf("match should go on with 2 snakes")
+	}
+	game.players[2].Die(game.tick + 1)
+	game.tick++
+
+	if !game.isOver() {
+		t.Fatalf("match should finish with the last snake")
+	}
+	standings := game.Result().Body.Standings
+	expected := []string{game.players[1].ID(), game.players[2].ID(), game.players[0].ID()}
+	for i, id := range expected {
+		if standings[i].ID != id || standings[i].Rank != i+1 {
+			t.Errorf("standing %d: expected %s, but got %+v", i, id, standings[i])
+		}
+	}
+	if standings[0].Kills != 1 {
+		t.Errorf("kills: expected 1, but got %d", standings[0].Kills)
+	}
+}
+
+func TestGame_Result_Length(t *testing.T) {
+	cfg := DefaultGameConfig()
+	cfg.WinCondition = api.WinLength
+	cfg.TargetLength = 5
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	putSnake(game, 1, 20, 20, api.MoveRight)
+	game.board.SetCell(11, 10, api.CellApple)
+	game.players[0].size = 4
+
+	if !game.step() {
+		t.Fatalf("match should finish when a snake reaches the target length")
+	}
+	standings := game.Result().Body.Standings
+	if standings[0].ID != game.players[0].ID() || standings[0].Length != 5 {
+		t.Errorf("winner: expected %s with length 5, but got %+v", game.players[0].ID(), standings[0])
+	}
+}
+
+func TestGame_Result_Tie(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newEmptyGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	putSnake(game, 1, 12, 10, api.MoveLeft)
+
+	game.step()
+
+	for _, s := range game.Result().Body.Standings {
+		if s.Rank != 1 {
+			t.Errorf("rank: players in a head-on collision should share rank 1, but got %+v", s)
+		}
+	}
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/myoan/snake/api"
+)
+
+// Room is a single match hosted by the gameserver.
+// Each room owns its clients, its matchmaking state and its Game loop,
+// so one process can run many matches side by side.
+//
+// Every state of a room is owned by a single goroutine started by run.
+// Connects, disconnects and inputs of clients are sent to it over events,
+// and the goroutine also drives ticks of the match and the rematch timeout.
+type Room struct {
+	ID string
+	// Name is given by the client which created the room. Only clients which ask for the name join a named room.
+	Name string
+	// code is the join code of a private room, or empty if anyone who knows the name can join
+	code     string
+	Config   *GameConfig
+	Clients  []Client
+	SceneMng *SceneManager
+	Ingame   *Game
+	// Spectators are waiting for the match to start
+	Spectators []*Spectator
+	// matches is the number of matches played in the room
+	matches int
+	// rematch has the IDs of clients which asked for a rematch
+	rematch map[string]bool
+
+	events       chan TriggerArgument
+	done         chan struct{}
+	ticker       *time.Ticker
+	rematchTimer *time.Timer
+	// botTimer fills the room with bots when players have waited long enough
+	botTimer *time.Timer
+	// countdown ticks every second once enough players have joined, and the match starts when secondsLeft runs out
+	countdown   *time.Ticker
+	secondsLeft int
+	deleted     bool
+
+	// mu guards the snapshot of the room read by the GameEngine
+	mu      sync.Mutex
+	scene   int
+	players int
+	// pending is the number of clients routed to the room whose connect event is not handled yet
+	pending int
+	closed  bool
+}
+
+func NewRoom(cfg *GameConfig) *Room {
+	clients := make([]Client, 0)
+	mng := NewSceneManager()
+	return &Room{
+		ID:       uuid.NewString(),
+		Config:   cfg,
+		Clients:  clients,
+		SceneMng: mng,
+		events:   make(chan TriggerArgument),
+		done:     make(chan struct{}),
+		scene:    SceneMatchmaking,
+	}
+}
+
+// Update sends the event of the client to the room goroutine.
+// It must not be called from the room goroutine.
+func (r *Room) Update(data interface{}) error {
+	select {
+	case r.events <- data.(TriggerArgument):
+	case <-r.done:
+	}
+	return nil
+}
+
+// run handles events of the room until the room is deleted.
+func (r *Room) run(ge *GameEngine) {
+	defer close(r.done)
+	for !r.deleted {
+		var tick, rematch, bots, countdown <-chan time.Time
+		if r.ticker != nil {
+			tick = r.ticker.C
+		}
+		if r.rematchTimer != nil {
+			rematch = r.rematchTimer.C
+		}
+		if r.botTimer != nil {
+			bots = r.botTimer.C
+		}
+		if r.countdown != nil {
+			countdown = r.countdown.C
+		}
+
+		select {
+		case ta := <-r.events:
+			r.handle(ta)
+		case <-tick:
+			if r.Ingame.step() {
+				ge.finishRoom(r)
+			}
+		case <-rematch:
+			r.rematchTimer = nil
+			ge.timeoutRematch(r)
+		case <-bots:
+			r.botTimer = nil
+			ge.fillBots(r)
+		case <-countdown:
+			ge.tickCountdown(r)
+		}
+		r.publish()
+	}
+	log.Printf("Room %s closed", r.ID)
+}
+
+func (r *Room) handle(ta TriggerArgument) {
+	switch ta.EventType {
+	case EventClientConnect, EventClientSpectate:
+		r.mu.Lock()
+		r.pending--
+		closed := r.closed
+		r.deleted = closed && r.pending == 0
+		r.mu.Unlock()
+		if closed {
+			// the room was deleted while the client was on the way
+			refuse(ta.Client, fmt.Errorf("room %s is closed", r.ID))
+			return
+		}
+		go r.forward(ta.Client)
+	case EventClientInput:
+		req, _ := decodeRequest(ta.Client, ta.Message)
+		if req.Eventtype == api.EventTypeRestart {
+			ta.EventType = EventClientRestart
+		}
+	}
+
+	err := r.SceneMng.Update(ta)
+	if err != nil && ta.EventType != EventClientInput && ta.EventType != EventClientRestart && ta.EventType != EventClientResume {
+		// inputs and resumes are ignored out of the scenes which handle them
+		log.Printf("Room %s: %v", r.ID, err)
+	}
+}
+
+// forward sends requests of the client to the room goroutine until the stream is closed.
+func (r *Room) forward(c Client) {
+	stream := c.Stream()
+	for {
+		select {
+		case msg, ok := <-stream:
+			if !ok {
+				return
+			}
+			ta := TriggerArgument{
+				EventType: EventClientInput,
+				Client:    c,
+				Message:   msg,
+			}
+			select {
+			case r.events <- ta:
+			case <-r.done:
+				return
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// publish updates the snapshot for the GameEngine.
+func (r *Room) publish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scene = r.SceneMng.SceneID
+	r.players = len(r.Clients)
+}
+
+// reserve counts a client routed to the room, so that the room goroutine runs until the client arrives.
+// It returns false if the room is already closed.
+func (r *Room) reserve() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.pending++
+	return true
+}
+
+func (r *Room) AddClient(c Client) {
+	r.Clients = append(r.Clients, c)
+}
+
+func (r *Room) DeleteClient(cid string) {
+	for i, c := range r.Clients {
+		if c.ID() == cid {
+			r.Clients = append(r.Clients[:i], r.Clients[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *Room) AddSpectator(s *Spectator) {
+	r.Spectators = append(r.Spectators, s)
+}
+
+func (r *Room) DeleteSpectator(sid string) {
+	for i, s := range r.Spectators {
+		if s.ID() == sid {
+			r.Spectators = append(r.Spectators[:i], r.Spectators[i+1:]...)
+			return
+		}
+	}
+}
+
+// describe returns the name and whether the room is private for logs.
+func (r *Room) describe() string {
+	switch {
+	case r.code != "":
+		return fmt.Sprintf("'%s' (private) ", r.Name)
+	case r.Name != "":
+		return fmt.Sprintf("'%s' ", r.Name)
+	}
+	return ""
+}
+
+// humans returns the number of clients which are not bots.
+func (r *Room) humans() int {
+	n := 0
+	for _, c := range r.Clients {
+		if _, ok := c.(*BotClient); !ok {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *Room) ReachMaxClient() bool {
+	return len(r.Clients) >= r.Config.PlayerNum
+}
+
+// IsOpen reports whether the room still accepts new players.
+// It reads the snapshot, so it can be called from any goroutine.
+func (r *Room) IsOpen() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.closed && r.scene == SceneMatchmaking && r.players+r.pending < r.Config.PlayerNum
+}
+
+// accepts returns error if the client can not join the named room now.
+// A player arriving after the match started watches it as a spectator.
+// It reads the snapshot, so it can be called from any goroutine.
+func (r *Room) accepts(spectate bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case r.scene == SceneResult:
+		return fmt.Errorf("room '%s' is waiting for a rematch", r.Name)
+	case r.scene == SceneMatchmaking && !spectate && r.players+r.pending >= r.Config.PlayerNum:
+		return fmt.Errorf("room '%s' is full", r.Name)
+	}
+	return nil
+}
+
+// IsRunning reports whether a match is running in the room.
+// It reads the snapshot, so it can be called from any goroutine.
+func (r *Room) IsRunning() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.closed && r.scene == SceneIngame
+}
+
+// ExecuteIngame starts a match with the clients in the room.
+// A rematch reuses the board of the last match.
+func (r *Room) ExecuteIngame(rec Recorder) {
+	players := make([]*Player, len(r.Clients))
+	for i, c := range r.Clients {
+		players[i] = NewPlayer(c, r.Config)
+	}
+	event := make(chan Event)
+
+	seed := r.Config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if r.Ingame != nil {
+		r.Ingame = r.Ingame.Rematch(seed, event, players)
+	} else {
+		r.Ingame = NewGame(r.Config, seed, event, players)
+	}
+	r.matches++
+	r.Ingame.SetRecorder(rec)
+	for _, s := range r.Spectators {
+		r.Ingame.AddSpectator(s)
+	}
+	r.Spectators = nil
+
+	meta, _ := json.Marshal(r.Ingame.Meta())
+	log.Printf("Room %s start match: %s", r.ID, meta)
+	r.Ingame.Start()
+	r.ticker = time.NewTicker(r.Config.Tick())
+}
+
+// player returns the player of the client in the running match.
+func (r *Room) player(cid string) *Player {
+	for _, p := range r.Ingame.players {
+		if p.ID() == cid {
+			return p
+		}
+	}
+	return nil
+}
+
+// isEmpty reports whether nobody is in the room.
+func (r *Room) isEmpty() bool {
+	if len(r.Clients) > 0 || len(r.Spectators) > 0 {
+		return false
+	}
+	return r.Ingame == nil || len(r.Ingame.Spectators()) == 0
+}
+
+// setupRoom registers the scene handlers which drive a room from matchmaking to the end of the match.
+// Handlers are called from the room goroutine.
+func (ge *GameEngine) setupRoom(room *Room) {
+	room.SceneMng.AddHandler(EventClientConnect, SceneMatchmaking, func(args interface{}) {
+		log.Printf("Room %s Scene: MatchMaking (%d)\n", room.ID, len(room.Clients))
+		ta := args.(TriggerArgument)
+		room.AddClient(ta.Client)
+		resp := &api.InitResponse{
+			Status: api.GameStatusInit,
+			ID:     ta.Client.ID(),
+			Config: room.Config.Protocol(),
+			Token:  ta.Client.Token(),
+		}
+		sendFrame(ta.Client, resp)
+		ge.matchmake(room)
+	})
+
+	room.SceneMng.AddHandler(EventClientSpectate, SceneMatchmaking, func(args interface{}) {
+		log.Printf("Room %s Scene: MatchMaking, spectate\n", room.ID)
+		ta := args.(TriggerArgument)
+		room.AddSpectator(NewSpectator(ta.Client))
+		sendSpectatorInit(room, ta.Client)
+		sendFrame(ta.Client, room.waiting())
+	})
+
+	room.SceneMng.AddHandler(EventClientFinish, SceneMatchmaking, func(args interface{}) {
+		log.Printf("Room %s Trigger: EventClientFinish while matchmaking\n", room.ID)
+		ta := args.(TriggerArgument)
+		room.DeleteClient(ta.Client.ID())
+		room.DeleteSpectator(ta.Client.ID())
+		if room.humans() == 0 {
+			// bots left from the last match do not wait for players
+			room.stopBots()
+			closeClients(room.Clients)
+			room.Clients = nil
+		}
+		if room.isEmpty() {
+			room.stopBots()
+			room.stopCountdown()
+			ge.DeleteRoom(room)
+			return
+		}
+		ge.matchmake(room)
+	})
+
+	// A player arriving after the match started joins as a spectator.
+	spectate := func(args interface{}) {
+		log.Printf("Room %s Scene: Ingame, spectate\n", room.ID)
+		ta := args.(TriggerArgument)
+		room.Ingame.AddSpectator(NewSpectator(ta.Client))
+		sendSpectatorInit(room, ta.Client)
+	}
+	room.SceneMng.AddHandler(EventClientConnect, SceneIngame, spectate)
+	room.SceneMng.AddHandler(EventClientSpectate, SceneIngame, spectate)
+
+	room.SceneMng.AddHandler(EventClientInput, SceneIngame, func(args interface{}) {
+		ta := args.(TriggerArgument)
+		p := room.player(ta.Client.ID())
+		if p == nil {
+			// requests from spectators are ignored
+			return
+		}
+		req, err := decodeRequest(ta.Client, ta.Message)
+		if err != nil {
+			log.Printf("Room %s: decode request from %s: %v", room.ID, ta.Client.ID(), err)
+			return
+		}
+		if req.Eventtype == api.EventTypeMove {
+			p.Queue(req.Key)
+		}
+	})
+
+	// A resumed client may have lost frames, so it needs a keyframe before delta frames.
+	room.SceneMng.AddHandler(EventClientResume, SceneIngame, func(args interface{}) {
+		ta := args.(TriggerArgument)
+		room.Ingame.Resync(ta.Client.ID())
+	})
+
+	// The room is deleted after the match if every player has left.
+	// Bots do not play on by themselves, so the match finishes when the last player leaves it.
+	room.SceneMng.AddHandler(EventClientFinish, SceneIngame, func(args interface{}) {
+		log.Printf("Room %s Trigger: EventClientFinish\n", room.ID)
+		ta := args.(TriggerArgument)
+		room.DeleteClient(ta.Client.ID())
+		room.Ingame.DeleteSpectator(ta.Client.ID())
+		if room.humans() == 0 && len(room.Clients) > 0 && len(room.Ingame.Spectators()) == 0 {
+			ge.finishRoom(room)
+		}
+	})
+
+	// A client routed to the room before the match finished can not join the rematch of others.
+	late := func(args interface{}) {
+		ta := args.(TriggerArgument)
+		log.Printf("Room %s Scene: Result, refuse %s\n", room.ID, ta.Client.ID())
+		refuse(ta.Client, fmt.Errorf("the match in room %s has finished", room.ID))
+	}
+	room.SceneMng.AddHandler(EventClientConnect, SceneResult, late)
+	room.SceneMng.AddHandler(EventClientSpectate, SceneResult, late)
+
+	room.SceneMng.AddHandler(EventClientRestart, SceneResult, func(args interface{}) {
+		log.Printf("Room %s Scene: Result, restart\n", room.ID)
+		ta := args.(TriggerArgument)
+		room.rematch[ta.Client.ID()] = true
+
+		// players in the rematch are those who asked for it
+		data := &api.WaitingResponse{
+			Status: api.GameStatusWaiting,
+			Body: api.WaitingBody{
+				Players:    len(room.rematch),
+				Needed:     len(room.Clients) - len(room.rematch),
+				MaxPlayers: room.Config.PlayerNum,
+			},
+		}
+		sendFrame(ta.Client, data)
+		ge.checkRematch(room)
+	})
+
+	room.SceneMng.AddHandler(EventClientFinish, SceneResult, func(args interface{}) {
+		log.Printf("Room %s Trigger: EventClientFinish after the match\n", room.ID)
+		ta := args.(TriggerArgument)
+		room.DeleteClient(ta.Client.ID())
+		delete(room.rematch, ta.Client.ID())
+		ge.checkRematch(room)
+	})
+}
+
+// finishRoom waits for a rematch after the match finished.
+// If rematches are disabled, every player is disconnected.
+func (ge *GameEngine) finishRoom(room *Room) {
+	log.Printf("Room %s match finished", room.ID)
+	room.ticker.Stop()
+	room.ticker = nil
+	room.Ingame.finish()
+	room.SceneMng.MoveScene(SceneResult)
+
+	if room.Config.RematchTimeout == 0 || room.humans() == 0 {
+		closeClients(room.Clients)
+		room.Clients = nil
+		ge.DeleteRoom(room)
+		return
+	}
+
+	room.rematch = make(map[string]bool)
+	room.rematchTimer = time.NewTimer(room.Config.RematchWait())
+}
+
+// checkRematch starts a rematch when every player asked for it.
+// If players have left, the rest go back to matchmaking instead.
+func (ge *GameEngine) checkRematch(room *Room) {
+	if room.humans() == 0 {
+		room.stopRematch()
+		closeClients(room.Clients)
+		room.Clients = nil
+		ge.DeleteRoom(room)
+		return
+	}
+	for _, c := range room.Clients {
+		if !room.rematch[c.ID()] {
+			return
+		}
+	}
+	room.stopRematch()
+
+	if len(room.Clients) >= room.Config.MinPlayerNum() {
+		log.Printf("Room %s rematch", room.ID)
+		room.SceneMng.MoveScene(SceneIngame)
+		ge.startRoom(room)
+	} else {
+		log.Printf("Room %s back to matchmaking", room.ID)
+		room.SceneMng.MoveScene(SceneMatchmaking)
+		ge.matchmake(room)
+	}
+}
+
+// timeoutRematch sends players who asked for a rematch back to matchmaking, and disconnects the others.
+func (ge *GameEngine) timeoutRematch(room *Room) {
+	var stay, leave []Client
+	for _, c := range room.Clients {
+		if room.rematch[c.ID()] {
+			stay = append(stay, c)
+		} else {
+			leave = append(leave, c)
+		}
+	}
+	room.Clients = stay
+	if room.humans() == 0 {
+		leave = append(leave, stay...)
+		room.Clients = nil
+	}
+	closeClients(leave)
+
+	if len(room.Clients) == 0 {
+		ge.DeleteRoom(room)
+		return
+	}
+	log.Printf("Room %s rematch timed out, %d players back to matchmaking", room.ID, len(room.Clients))
+	room.SceneMng.MoveScene(SceneMatchmaking)
+	ge.matchmake(room)
+}
+
+// matchmake starts the match at once if the room is full, or counts down once enough players have joined.
+// Everyone in the room is told the players and the seconds left.
+func (ge *GameEngine) matchmake(room *Room) {
+	if room.ReachMaxClient() {
+		room.SceneMng.MoveScene(SceneIngame)
+		ge.startRoom(room)
+		return
+	}
+	if len(room.Clients) >= room.Config.MinPlayerNum() {
+		if room.Config.Countdown == 0 {
+			room.SceneMng.MoveScene(SceneIngame)
+			ge.startRoom(room)
+			return
+		}
+		room.startCountdown()
+	} else {
+		room.stopCountdown()
+	}
+	if len(room.Clients) > 0 {
+		room.waitBots()
+	}
+
+	resp := room.waiting()
+	for _, c := range room.Clients {
+		sendFrame(c, resp)
+	}
+	for _, s := range room.Spectators {
+		sendFrame(s.Client, resp)
+	}
+}
+
+// waiting returns the frame which tells the matchmaking state.
+func (r *Room) waiting() *api.WaitingResponse {
+	body := api.WaitingBody{
+		Players:    len(r.Clients),
+		MaxPlayers: r.Config.PlayerNum,
+	}
+	if n := r.Config.MinPlayerNum() - len(r.Clients); n > 0 {
+		body.Needed = n
+	}
+	if r.countdown != nil {
+		body.SecondsLeft = r.secondsLeft
+	}
+	return &api.WaitingResponse{
+		Status: api.GameStatusWaiting,
+		Body:   body,
+	}
+}
+
+// startCountdown starts the countdown unless it is already running.
+func (r *Room) startCountdown() {
+	if r.countdown != nil {
+		return
+	}
+	log.Printf("Room %s starts in %d seconds", r.ID, r.Config.Countdown)
+	r.secondsLeft = r.Config.Countdown
+	r.countdown = time.NewTicker(time.Second)
+}
+
+func (r *Room) stopCountdown() {
+	if r.countdown != nil {
+		r.countdown.Stop()
+		r.countdown = nil
+	}
+}
+
+// tickCountdown starts the match when the countdown runs out, otherwise tells the seconds left.
+func (ge *GameEngine) tickCountdown(room *Room) {
+	room.secondsLeft--
+	if room.secondsLeft > 0 {
+		ge.matchmake(room)
+		return
+	}
+	room.SceneMng.MoveScene(SceneIngame)
+	ge.startRoom(room)
+}
+
+// waitBots starts the timer to fill the room with bots, unless it is already running or bots are disabled.
+func (r *Room) waitBots() {
+	if r.botTimer != nil || r.Config.BotWait == 0 {
+		return
+	}
+	r.botTimer = time.NewTimer(r.Config.BotFillWait())
+}
+
+func (r *Room) stopBots() {
+	if r.botTimer != nil {
+		r.botTimer.Stop()
+		r.botTimer = nil
+	}
+}
+
+// fillBots starts the match with bots in the empty slots.
+func (ge *GameEngine) fillBots(room *Room) {
+	if room.SceneMng.SceneID != SceneMatchmaking || room.humans() == 0 || room.ReachMaxClient() {
+		return
+	}
+	n := 0
+	for !room.ReachMaxClient() {
+		bot := NewBotClient(room.Config)
+		bot.AddObserver(room)
+		room.AddClient(bot)
+		go room.forward(bot)
+		go bot.Run()
+		n++
+	}
+	log.Printf("Room %s fill %d slots with bots", room.ID, n)
+	room.SceneMng.MoveScene(SceneIngame)
+	ge.startRoom(room)
+}
+
+func (r *Room) stopRematch() {
+	if r.rematchTimer != nil {
+		r.rematchTimer.Stop()
+		r.rematchTimer = nil
+	}
+}
+
+// closeClients disconnects the clients without blocking the room goroutine,
+// because Close notifies the room of the disconnection.
+func closeClients(clients []Client) {
+	for _, c := range clients {
+		go c.Close()
+	}
+}
+
+// refuse sends the reason to the client and disconnects it without blocking the room goroutine.
+func refuse(c Client, err error) {
+	sendFrame(c, &api.EventResponse{
+		Status: api.GameStatusError,
+		Error:  err.Error(),
+	})
+	go c.Close()
+}
+
+func sendSpectatorInit(room *Room, c Client) {
+	resp := &api.InitResponse{
+		Status:    api.GameStatusInit,
+		ID:        c.ID(),
+		Config:    room.Config.Protocol(),
+		Spectator: true,
+		Token:     c.Token(),
+	}
+	sendFrame(c, resp)
+}
@@ -0,0 +1,17 @@
+package main
+
+// Spectator is a read-only observer of a match.
+// It receives the same frames as players, but it has no snake and every request from it is ignored.
+type Spectator struct {
+	Client Client
+}
+
+func NewSpectator(client Client) *Spectator {
+	return &Spectator{
+		Client: client,
+	}
+}
+
+func (s *Spectator) ID() string {
+	return s.Client.ID()
+}
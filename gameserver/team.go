@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math/rand"
+
+	"github.com/myoan/snake/api"
+)
+
+// teamColors are the colors of teams in order of team IDs, which limit the number of teams.
+var teamColors = []string{
+	"#e74c3c",
+	"#3498db",
+	"#2ecc71",
+	"#f1c40f",
+	"#9b59b6",
+	"#e67e22",
+	"#1abc9c",
+	"#ecf0f1",
+}
+
+// assignTeams deals players to teams in turn after shuffling them by the RNG of the match,
+// so that teams differ by at most one player and the connection order does not matter.
+// Teams are cleared if the config has no teams.
+func assignTeams(players []*Player, teams int, rng *rand.Rand) {
+	if teams == 0 {
+		for _, p := range players {
+			p.team = 0
+		}
+		return
+	}
+	for i, j := range rng.Perm(len(players)) {
+		players[j].team = i%teams + 1
+	}
+}
+
+// passThrough reports whether the snake of player i passes through the snake of player j,
+// which is true only for teammates whose bodies are passable.
+func (game *Game) passThrough(i, j int) bool {
+	if i == j || game.config.TeamBodies != api.TeamBodyPassable {
+		return false
+	}
+	a, b := game.players[i], game.players[j]
+	return a.team != 0 && a.team == b.team
+}
+
+// aliveTeams returns the number of teams which have a snake alive.
+func (game *Game) aliveTeams() int {
+	teams := make(map[int]bool)
+	for _, p := range game.players {
+		if p.State == 0 {
+			teams[p.team] = true
+		}
+	}
+	return len(teams)
+}
+
+// longestTeam returns the longest combined length of the teams, which counts snakes dead or alive.
+func (game *Game) longestTeam() int {
+	lengths := make(map[int]int)
+	longest := 0
+	for _, p := range game.players {
+		lengths[p.team] += p.size
+		if lengths[p.team] > longest {
+			longest = lengths[p.team]
+		}
+	}
+	return longest
+}
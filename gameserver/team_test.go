@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/myoan/snake/api"
+)
+
+func TestAssignTeams(t *testing.T) {
+	cfg := DefaultGameConfig()
+	players := make([]*Player, 5)
+	for i := range players {
+		players[i] = NewPlayer(NewDummyClient(string(rune('a'+i))), cfg)
+	}
+
+	assignTeams(players, 2, rand.New(rand.NewSource(1)))
+	counts := make(map[int]int)
+	first := make([]int, len(players))
+	for i, p := range players {
+		counts[p.team]++
+		first[i] = p.team
+	}
+	if counts[1] != 3 || counts[2] != 2 {
+		t.Errorf("expected teams of 3 and 2, but got %v", counts)
+	}
+
+	// the same seed makes the same teams, so that replays reproduce them
+	assignTeams(players, 2, rand.New(rand.NewSource(1)))
+	for i, p := range players {
+		if p.team != first[i] {
+			t.Errorf("player %d: expected team %d, but got %d", i, first[i], p.team)
+		}
+	}
+
+	assignTeams(players, 0, nil)
+	for i, p := range players {
+		if p.team != 0 {
+			t.Errorf("player %d: expected no team, but got %d", i, p.team)
+		}
+	}
+}
+
+// newTeamGame returns an empty game of 3 players, where players 0 and 1 are teammates.
+func newTeamGame(cfg *GameConfig) *Game {
+	cfg.PlayerNum = 3
+	cfg.Teams = 2
+	game := newEmptyGame(cfg)
+	game.players[0].team = 1
+	game.players[1].team = 1
+	game.players[2].team = 2
+	return game
+}
+
+func TestGame_Step_TeamBodies(t *testing.T) {
+	for _, bodies := range []string{api.TeamBodyLethal, api.TeamBodyPassable} {
+		cfg := DefaultGameConfig()
+		cfg.TeamBodies = bodies
+		game := newTeamGame(cfg)
+		putSnake(game, 0, 10, 10, api.MoveRight)
+		putSnake(game, 1, 20, 20, api.MoveRight)
+		putSnake(game, 2, 30, 30, api.MoveRight)
+		// player 0 runs into the body of the teammate
+		game.board.SetBody(11, 10, 2, 1)
+
+		game.step()
+
+		dead := game.players[0].State == 1
+		if dead != (bodies == api.TeamBodyLethal) {
+			t.Errorf("%s: expected dead=%v, but got %v", bodies, !dead, dead)
+		}
+	}
+}
+
+func TestGame_Result_LastTeam(t *testing.T) {
+	cfg := DefaultGameConfig()
+	game := newTeamGame(cfg)
+	putSnake(game, 0, 10, 10, api.MoveRight)
+	putSnake(game, 1, 20, 20, api.MoveRight)
+	putSnake(game, 2, 30, 30, api.MoveRight)
+
+	game.players[1].Die(1)
+	if game.isOver() {
+		t.Fatalf("match should go on while 2 teams are alive")
+	}
+	game.players[2].Die(2)
+	game.tick = 2
+	if !game.isOver() {
+		t.Fatalf("match should finish with the last team")
+	}
+
+	result := game.Result().Body
+	for _, s := range result.Standings {
+		expected := 2
+		if s.Team == 1 {
+			expected = 1
+		}
+		if s.Rank != expected {
+			t.Errorf("%s of team %d: expected rank %d, but got %d", s.ID, s.Team, expected, s.Rank)
+		}
+	}
+	if len(result.Teams) != 2 || result.Teams[0].Team != 1 || !result.Teams[0].Alive {
+		t.Errorf("expected team 1 to win, but got %+v", result.Teams)
+	}
+}
+
+func TestGame_Result_CombinedLength(t *testing.T) {
+	cfg := DefaultGameConfig()
+	cfg.WinCondition = api.WinTimeLimit
+	cfg.TimeLimit = 1
+	game := newTeamGame(cfg)
+	game.players[0].size = 3
+	game.players[1].size = 3
+	game.players[2].size = 5
+	// the wiped out team still wins by the combined length
+	game.players[0].Die(1)
+	game.players[1].Die(1)
+
+	teams := game.Result().Body.Teams
+	if teams[0].Team != 1 || teams[0].Length != 6 || teams[1].Length != 5 {
+		t.Errorf("expected team 1 to win with the combined length 6, but got %+v", teams)
+	}
+}
+
+func TestGame_Result_TeamLength(t *testing.T) {
+	cfg := DefaultGameConfig()
+	cfg.WinCondition = api.WinLength
+	cfg.TargetLength = 10
+	game := newTeamGame(cfg)
+	game.players[0].size = 5
+	game.players[1].size = 4
+	game.players[2].size = 9
+	if game.isOver() {
+		t.Fatalf("match should go on while no team reaches the target")
+	}
+
+	// team 1 reaches the target by the combined length before the longest snake does
+	game.players[1].size = 5
+	if !game.isOver() {
+		t.Fatalf("match should finish when the combined length reaches the target")
+	}
+	teams := game.Result().Body.Teams
+	if teams[0].Team != 1 || teams[0].Length != 10 || teams[1].Rank != 2 {
+		t.Errorf("expected team 1 to win with the combined length 10, but got %+v", teams)
+	}
+}